@@ -0,0 +1,327 @@
+package binlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/go-kratos/kratos/v2/transport"
+	"github.com/go-mysql-org/go-mysql/canal"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ transport.Server = (*BulkSink)(nil)
+
+// BulkSink 将行变更批量写入 Elasticsearch 风格的 _bulk 接口
+// insert、update 以主键 index 文档, delete 以主键删除文档
+// 通过 Server.Register 注册 BulkSink 本身时, 保存同步点前会写入缓冲, 写入失败时不保存同步点
+type BulkSink struct {
+	sync.Mutex
+	sendMu sync.Mutex // 按顺序写入, 不阻塞缓冲
+
+	endpoint   string
+	client     *http.Client
+	size       int
+	bytes      int
+	interval   time.Duration
+	retries    int
+	backoff    time.Duration
+	indexName  func(schema, table string) string
+	documentID func(*Event) string
+
+	buf    bytes.Buffer
+	count  int
+	err    error // 重试后仍失败的写入, 之后不再保存同步点
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type BulkOption func(*BulkSink)
+
+// WithBulkClient 自定义 http 客户端
+func WithBulkClient(client *http.Client) BulkOption {
+	return func(b *BulkSink) {
+		b.client = client
+	}
+}
+
+// WithBulkSize 累计条数或字节数达到阈值时写入
+func WithBulkSize(size, maxBytes int) BulkOption {
+	return func(b *BulkSink) {
+		b.size = size
+		b.bytes = maxBytes
+	}
+}
+
+// WithBulkInterval 定时写入的间隔
+func WithBulkInterval(interval time.Duration) BulkOption {
+	return func(b *BulkSink) {
+		b.interval = interval
+	}
+}
+
+// WithBulkRetry 写入失败的重试次数以及首次重试间隔, 之后每次翻倍
+func WithBulkRetry(retries int, backoff time.Duration) BulkOption {
+	return func(b *BulkSink) {
+		b.retries = retries
+		b.backoff = backoff
+	}
+}
+
+// WithBulkIndex 按库、表命名索引
+func WithBulkIndex(f func(schema, table string) string) BulkOption {
+	return func(b *BulkSink) {
+		b.indexName = f
+	}
+}
+
+// WithBulkDocumentID 自定义文档ID, 默认使用主键值
+func WithBulkDocumentID(f func(*Event) string) BulkOption {
+	return func(b *BulkSink) {
+		b.documentID = f
+	}
+}
+
+func NewBulkSink(endpoint string, opts ...BulkOption) *BulkSink {
+	b := &BulkSink{
+		endpoint: strings.TrimRight(endpoint, "/") + "/_bulk",
+		client:   &http.Client{Timeout: 30 * time.Second},
+		size:     500,
+		bytes:    5 << 20,
+		interval: time.Second,
+		retries:  3,
+		backoff:  500 * time.Millisecond,
+		indexName: func(schema, table string) string {
+			// 分表写入同一个索引
+			return regexp.MustCompile(`_\d{6}$`).ReplaceAllString(table, "")
+		},
+		documentID: func(ev *Event) string {
+			return ev.Record
+		},
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	for _, o := range opts {
+		o(b)
+	}
+	return b
+}
+
+func (b *BulkSink) Name() string {
+	return "binlog.bulk"
+}
+
+// Handle 实现 EventHandle, 通过 Server.Register 注册到表
+func (b *BulkSink) Handle(ev *Event) error {
+	meta := map[string]map[string]string{}
+	target := map[string]string{"_index": b.indexName(ev.Schema, ev.Table), "_id": b.documentID(ev)}
+	var doc []byte
+	switch ev.Action {
+	case canal.InsertAction, canal.UpdateAction:
+		meta["index"] = target
+		var err error
+		if doc, err = json.Marshal(ev.Values); err != nil {
+			return err
+		}
+	case canal.DeleteAction:
+		meta["delete"] = target
+	default:
+		return nil
+	}
+	line, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	b.Lock()
+	b.buf.Write(line)
+	b.buf.WriteByte('\n')
+	if doc != nil {
+		b.buf.Write(doc)
+		b.buf.WriteByte('\n')
+	}
+	b.count++
+	full := b.count >= b.size || b.buf.Len() >= b.bytes
+	b.Unlock()
+
+	if full {
+		return b.flush(b.ctx)
+	}
+	return nil
+}
+
+// Flush 立即写入缓冲的请求, 之前有写入失败时同样返回错误
+func (b *BulkSink) Flush() error {
+	return b.flush(b.ctx)
+}
+
+// take 取出缓冲的请求
+func (b *BulkSink) take() []byte {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.count == 0 {
+		return nil
+	}
+	body := make([]byte, b.buf.Len())
+	copy(body, b.buf.Bytes())
+	b.buf.Reset()
+	b.count = 0
+	return body
+}
+
+// flush 在锁外写入取出的请求, 重试后仍失败时记录错误
+func (b *BulkSink) flush(ctx context.Context) error {
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+
+	if body := b.take(); body != nil {
+		if err := b.write(ctx, body); err != nil {
+			b.Lock()
+			b.err = err
+			b.Unlock()
+		}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	return b.err
+}
+
+func (b *BulkSink) write(ctx context.Context, body []byte) error {
+	backoff := b.backoff
+	for i := 0; ; i++ {
+		retry, err := b.send(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if i >= b.retries {
+			log.Errorf("[%s] bulk request failed after %d retries: %v", b.Name(), i, err)
+			return err
+		}
+		log.Warnf("[%s] bulk request failed, retrying in %v: %v", b.Name(), backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+		if len(retry) > 0 {
+			body = retry
+		}
+	}
+}
+
+// bulkResponse _bulk 接口返回值, 只解析需要的字段
+type bulkResponse struct {
+	Errors bool                            `json:"errors"`
+	Items  []map[string]bulkResponseResult `json:"items"`
+}
+
+type bulkResponseResult struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// send 发送请求, 部分失败时返回需要重试的请求行
+func (b *BulkSink) send(ctx context.Context, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("bulk status %d: %s", resp.StatusCode, data)
+	}
+	var result bulkResponse
+	if err = json.Unmarshal(data, &result); err != nil || !result.Errors {
+		return nil, err
+	}
+
+	// 429、5xx 重新提交, 其余错误记录日志后丢弃
+	var retry bytes.Buffer
+	lines := bytes.Split(bytes.TrimRight(body, "\n"), []byte("\n"))
+	i := 0
+	for _, items := range result.Items {
+		// 每个结果只有一个 key, 为对应的操作
+		for action, item := range items {
+			size := 2
+			if action == "delete" {
+				size = 1
+			}
+			if i+size > len(lines) {
+				break
+			}
+			switch {
+			case item.Status == http.StatusTooManyRequests || item.Status >= 500:
+				retry.Write(bytes.Join(lines[i:i+size], []byte("\n")))
+				retry.WriteByte('\n')
+			case item.Status >= 300:
+				log.Errorf("[%s] bulk %s failed, status %d: %s", b.Name(), action, item.Status, item.Error)
+			}
+			i += size
+		}
+	}
+	if retry.Len() == 0 {
+		return nil, nil
+	}
+	return retry.Bytes(), fmt.Errorf("bulk partially failed")
+}
+
+// Start 定时写入, ctx 结束时停止定时写入
+func (b *BulkSink) Start(ctx context.Context) error {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_ = b.Flush()
+			case <-ctx.Done():
+				return
+			case <-b.ctx.Done():
+				return
+			}
+		}
+	}()
+	log.Infof("[%s] server starting.", b.Name())
+	return nil
+}
+
+// Stop 在 ctx 结束前写入剩余数据, 之后取消进行中的请求
+func (b *BulkSink) Stop(ctx context.Context) error {
+	defer log.Infof("[%s] server stopping.", b.Name())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- b.flush(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	b.cancel()
+	b.wg.Wait()
+	return err
+}
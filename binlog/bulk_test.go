@@ -0,0 +1,98 @@
+package binlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+)
+
+// 部分失败时只重新提交 429、5xx 的请求行, delete 只占一行
+func TestBulkSinkRetryPartialFailure(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		bodies [][]byte
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, body)
+		n := len(bodies)
+		mu.Unlock()
+
+		if n == 1 {
+			// index 1 成功, delete 2 限流, index 3 失败不重试, index 4 服务端错误
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"errors": true,
+				"items": []map[string]interface{}{
+					{"index": map[string]interface{}{"status": 201}},
+					{"delete": map[string]interface{}{"status": 429}},
+					{"index": map[string]interface{}{"status": 400, "error": "mapper_parsing_exception"}},
+					{"index": map[string]interface{}{"status": 503}},
+				},
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": false})
+	}))
+	defer srv.Close()
+
+	sink := NewBulkSink(srv.URL, WithBulkSize(100, 1<<20), WithBulkRetry(2, time.Millisecond))
+	events := []*Event{
+		{Record: "1", Table: "user", Action: canal.InsertAction, Values: map[string]interface{}{"id": 1}},
+		{Record: "2", Table: "user", Action: canal.DeleteAction},
+		{Record: "3", Table: "user", Action: canal.UpdateAction, Values: map[string]interface{}{"id": 3}},
+		{Record: "4", Table: "user", Action: canal.InsertAction, Values: map[string]interface{}{"id": 4}},
+	}
+	for _, ev := range events {
+		if err := sink.Handle(ev); err != nil {
+			t.Fatalf("handle: %v", err)
+		}
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	if len(bodies) != 2 {
+		t.Fatalf("requests = %d, want 2", len(bodies))
+	}
+	lines := bytes.Split(bytes.TrimRight(bodies[1], "\n"), []byte("\n"))
+	want := []string{
+		`{"delete":{"_id":"2","_index":"user"}}`,
+		`{"index":{"_id":"4","_index":"user"}}`,
+		`{"id":4}`,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("retry lines = %q, want %q", lines, want)
+	}
+	for i := range want {
+		if string(lines[i]) != want[i] {
+			t.Errorf("retry line %d = %s, want %s", i, lines[i], want[i])
+		}
+	}
+}
+
+// 重试后仍失败时返回错误, 保存同步点前的 Flush 同样失败
+func TestBulkSinkFlushErrorIsSticky(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	sink := NewBulkSink(srv.URL, WithBulkRetry(1, time.Millisecond))
+	if err := sink.Handle(&Event{Record: "1", Table: "user", Action: canal.DeleteAction}); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	if err := sink.Flush(); err == nil {
+		t.Fatal("flush error = nil, want error")
+	}
+	if err := sink.Flush(); err == nil {
+		t.Fatal("second flush error = nil, want sticky error")
+	}
+}
@@ -0,0 +1,150 @@
+package binlog
+
+import (
+	"fmt"
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"regexp"
+	"time"
+)
+
+var (
+	metricCacheKeys = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "binlog",
+		Subsystem: "cache",
+		Name:      "keys_total",
+		Help:      "The total number of invalidated cache keys",
+	}, []string{"table", "result"})
+
+	metricCacheSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "binlog",
+		Subsystem: "cache",
+		Name:      "duration_sec",
+		Help:      "binlog cache invalidation duratio(sec).",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.250, 0.5},
+	}, []string{"table"})
+
+	cacheKeyField = regexp.MustCompile(`\{(\w+)\}`)
+)
+
+func init() {
+	prometheus.MustRegister(metricCacheKeys, metricCacheSeconds)
+}
+
+// CacheSink 行变更时删除 Redis 缓存
+// 按表配置 key 模板, 如 user:{id}, 更新时同时删除更新前、更新后两份数据对应的 key
+type CacheSink struct {
+	client redis.UniversalClient
+	keys   map[string][]string
+	unlink bool
+	dryRun bool
+}
+
+type CacheOption func(*CacheSink)
+
+// WithCacheKeys 表对应的 key 模板, {column} 替换为列值
+func WithCacheKeys(table string, templates ...string) CacheOption {
+	return func(c *CacheSink) {
+		c.keys[table] = append(c.keys[table], templates...)
+	}
+}
+
+// WithCacheUnlink 使用 UNLINK 代替 DEL, 由 Redis 异步释放内存
+func WithCacheUnlink() CacheOption {
+	return func(c *CacheSink) {
+		c.unlink = true
+	}
+}
+
+// WithCacheDryRun 只记录日志, 不删除
+func WithCacheDryRun() CacheOption {
+	return func(c *CacheSink) {
+		c.dryRun = true
+	}
+}
+
+func NewCacheSink(client redis.UniversalClient, opts ...CacheOption) *CacheSink {
+	c := &CacheSink{
+		client: client,
+		keys:   make(map[string][]string),
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// Handle 实现 EventHandle, 通过 Server.Register 注册到表
+func (c *CacheSink) Handle(ev *Event) error {
+	// 处理分表
+	table := regexp.MustCompile(`_\d{6}$`).ReplaceAllString(ev.Table, "")
+	templates, ok := c.keys[table]
+	if !ok {
+		return nil
+	}
+
+	keys := make([]string, 0, len(templates)*2)
+	exist := make(map[string]struct{})
+	for _, values := range []map[string]interface{}{ev.Before, ev.Values} {
+		for _, template := range templates {
+			key, ok := cacheKey(template, values)
+			if !ok {
+				continue
+			}
+			if _, ok = exist[key]; !ok {
+				exist[key] = struct{}{}
+				keys = append(keys, key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if c.dryRun {
+		log.Infof("[binlog.cache] dry run %s %s: %v", table, ev.Action, keys)
+		metricCacheKeys.WithLabelValues(table, "dry_run").Add(float64(len(keys)))
+		return nil
+	}
+
+	start := time.Now()
+	ctx := ev.Context()
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			if c.unlink {
+				pipe.Unlink(ctx, key)
+			} else {
+				pipe.Del(ctx, key)
+			}
+		}
+		return nil
+	})
+	metricCacheSeconds.WithLabelValues(table).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metricCacheKeys.WithLabelValues(table, "error").Add(float64(len(keys)))
+		return err
+	}
+	metricCacheKeys.WithLabelValues(table, "success").Add(float64(len(keys)))
+	return nil
+}
+
+// cacheKey 使用列值替换模板, 缺少列时返回 false
+func cacheKey(template string, values map[string]interface{}) (string, bool) {
+	if values == nil {
+		return "", false
+	}
+	ok := true
+	key := cacheKeyField.ReplaceAllStringFunc(template, func(field string) string {
+		value, exist := values[field[1:len(field)-1]]
+		if !exist || value == nil {
+			ok = false
+			return ""
+		}
+		if b, isBytes := value.([]byte); isBytes {
+			return string(b)
+		}
+		return fmt.Sprintf("%v", value)
+	})
+	return key, ok
+}
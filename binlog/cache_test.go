@@ -0,0 +1,112 @@
+package binlog
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/redis/go-redis/v9"
+)
+
+// commandHook 记录执行的命令
+type commandHook struct {
+	sync.Mutex
+	commands []string
+}
+
+func (h *commandHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *commandHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return next
+}
+
+func (h *commandHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		h.Lock()
+		for _, cmd := range cmds {
+			h.commands = append(h.commands, cmd.Name())
+		}
+		h.Unlock()
+		return next(ctx, cmds)
+	}
+}
+
+func newTestCache(t *testing.T, keys ...string) (*miniredis.Miniredis, *redis.Client, *commandHook) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	for _, key := range keys {
+		if err := mr.Set(key, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	hook := &commandHook{}
+	client.AddHook(hook)
+	return mr, client, hook
+}
+
+func remainingKeys(mr *miniredis.Miniredis) []string {
+	keys := mr.Keys()
+	sort.Strings(keys)
+	return keys
+}
+
+// 更新时删除更新前、更新后两份数据的 key, 缺少列的模板跳过
+func TestCacheSinkUpdate(t *testing.T) {
+	mr, client, hook := newTestCache(t, "user:1", "user:name:tom", "user:name:jerry", "user:other")
+	sink := NewCacheSink(client, WithCacheKeys("user", "user:{id}", "user:name:{name}", "user:mail:{email}"))
+
+	err := sink.Handle(&Event{
+		Table:  "user_202401",
+		Action: canal.UpdateAction,
+		Before: map[string]interface{}{"id": 1, "name": []byte("tom")},
+		Values: map[string]interface{}{"id": 1, "name": "jerry", "email": nil},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := remainingKeys(mr), []string{"user:other"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("remaining keys = %v, want %v", got, want)
+	}
+	if got, want := hook.commands, []string{"del", "del", "del"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("commands = %v, want %v", got, want)
+	}
+}
+
+func TestCacheSinkUnlink(t *testing.T) {
+	mr, client, hook := newTestCache(t, "user:1")
+	sink := NewCacheSink(client, WithCacheKeys("user", "user:{id}"), WithCacheUnlink())
+
+	if err := sink.Handle(&Event{Table: "user", Action: canal.DeleteAction, Values: map[string]interface{}{"id": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("user:1") {
+		t.Fatal("user:1 still exists")
+	}
+	if got, want := hook.commands, []string{"unlink"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("commands = %v, want %v", got, want)
+	}
+}
+
+// dry run 只记录日志, key 保留
+func TestCacheSinkDryRun(t *testing.T) {
+	mr, client, hook := newTestCache(t, "user:1")
+	sink := NewCacheSink(client, WithCacheKeys("user", "user:{id}"), WithCacheDryRun())
+
+	if err := sink.Handle(&Event{Table: "user", Action: canal.DeleteAction, Values: map[string]interface{}{"id": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if !mr.Exists("user:1") {
+		t.Fatal("user:1 deleted in dry run")
+	}
+	if len(hook.commands) != 0 {
+		t.Fatalf("commands = %v, want none", hook.commands)
+	}
+}
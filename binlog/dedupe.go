@@ -0,0 +1,25 @@
+package binlog
+
+import (
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/tonyhal/hercules/dedupe"
+)
+
+// Idempotent 跳过已处理的事件, 处理成功后记录事件ID
+// 从同步点重启后重放的事件不会重复处理, store 见 dedupe 包
+func Idempotent(store dedupe.Store, h EventHandle) EventHandle {
+	return func(ev *Event) error {
+		seen, err := store.Seen(ev.Context(), ev.ID)
+		if err != nil {
+			return err
+		}
+		if seen {
+			log.Debugf("[binlog] skip duplicate event %s", ev.ID)
+			return nil
+		}
+		if err = h(ev); err != nil {
+			return err
+		}
+		return store.Mark(ev.Context(), ev.ID)
+	}
+}
@@ -1,11 +1,17 @@
 package binlog
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/go-kratos/kratos/v2/log"
 	"github.com/go-mysql-org/go-mysql/canal"
 	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/go-mysql-org/go-mysql/replication"
+	sch "github.com/go-mysql-org/go-mysql/schema"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/parser"
+	"github.com/pingcap/tidb/pkg/parser/ast"
 	"reflect"
 )
 
@@ -16,33 +22,158 @@ type gtidSetSaver struct {
 }
 
 type bulkRequest struct {
-	Record string
-	Table  string
-	Action string
-	Values string
+	Record  string
+	Schema  string
+	Table   string
+	Action  string
+	Values  string
+	Data    map[string]interface{}
+	Before  map[string]interface{}
+	Version int
+	GTID    string
+	ID      string
+}
+
+// Event 行变更事件
+type Event struct {
+	Record  string                 // 主键值
+	Schema  string                 // 数据库
+	Table   string                 // 表名(分表为实际表名)
+	Action  string                 // insert、update、delete
+	Values  map[string]interface{} // 列值
+	Before  map[string]interface{} // 更新前的列值, 只有 update 有
+	Version int                    // 解析该行时使用的表结构版本
+	GTID    string                 // 所在事务的 GTID
+	ID      string                 // 事件唯一ID, 从同步点重放时不变, 用于去重
+
+	ctx context.Context
+}
+
+// Context 由服务 context 派生, 服务停止时取消, 携带该事件的 span
+func (e *Event) Context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
 }
 
 type event struct {
 	srv *Server
+
+	// 当前 binlog 文件, 用于定位行所在位点
+	file string
+	// 当前事务的 GTID
+	gtid string
+	// 当前事务内的行事件序号
+	index int
 }
 
 func (e *event) OnRotate(eventHeader *replication.EventHeader, rotateEvent *replication.RotateEvent) error {
+	e.file = string(rotateEvent.NextLogName)
 	return nil
 }
 
 func (e *event) OnTableChanged(eventHeader *replication.EventHeader, schema string, table string) error {
+	// 表结构在 OnDDL 中按语句记录
 	return nil
 }
 
+// OnDDL 记录 DDL 之后的表结构, 从 DDL 的下一个位点开始生效
+// ALTER TABLE 应用到该位点之前的版本上, 重放多个 ALTER 时每个版本的列都对应当时的表结构
+// 无法按语句推断(CREATE、RENAME、分区等变更)时使用当前的表结构, 之后还有 DDL 时该版本的列可能不准确
 func (e *event) OnDDL(eventHeader *replication.EventHeader, nextPos mysql.Position, queryEvent *replication.QueryEvent) error {
+	stmts, _, err := parser.New().Parse(string(queryEvent.Query), "", "")
+	if err != nil {
+		return nil
+	}
+	pos := mysql.Position{Name: e.file, Pos: eventHeader.LogPos}
+	db := string(queryEvent.Schema)
+	for _, stmt := range stmts {
+		switch t := stmt.(type) {
+		case *ast.AlterTableStmt:
+			if err = e.recordAlter(t, db, pos); err != nil {
+				return err
+			}
+		case *ast.CreateTableStmt:
+			if err = e.recordCurrent(tableDB(t.Table, db), t.Table.Name.O, pos); err != nil {
+				return err
+			}
+		case *ast.RenameTableStmt:
+			for _, tt := range t.TableToTables {
+				if err = e.recordCurrent(tableDB(tt.NewTable, db), tt.NewTable.Name.O, pos); err != nil {
+					return err
+				}
+			}
+		}
+	}
 	return nil
 }
 
+func tableDB(t *ast.TableName, db string) string {
+	if len(t.Schema.O) > 0 {
+		return t.Schema.O
+	}
+	return db
+}
+
+// recordAlter 在之前的版本上应用 ALTER TABLE, 无法应用时使用当前的表结构
+func (e *event) recordAlter(stmt *ast.AlterTableStmt, db string, pos mysql.Position) error {
+	db, table := tableDB(stmt.Table, db), stmt.Table.Name.O
+	prev := e.srv.history.Lookup(db, table, pos)
+	if prev == nil {
+		return e.recordCurrent(db, table, pos)
+	}
+	// 从同步点重放时该位点已记录
+	if prev.position().Compare(pos) == 0 {
+		return nil
+	}
+	columns, pkColumns, ok := prev.alter(stmt)
+	if !ok {
+		log.Warnf("[binlog] cannot apply DDL at %s to %s.%s version %d, use the current table schema", pos, db, table, prev.Version)
+		return e.recordCurrent(db, table, pos)
+	}
+	_, err := e.srv.history.RecordColumns(db, table, columns, pkColumns, pos)
+	return err
+}
+
+// recordCurrent 记录当前的表结构
+func (e *event) recordCurrent(db, table string, pos mysql.Position) error {
+	t, err := e.srv.canal.GetTable(db, table)
+	if err != nil {
+		// 表被删除或未同步时不记录
+		if c := errors.Cause(err); c == canal.ErrExcludedTable || c == sch.ErrMissingTableMeta || c == sch.ErrTableNotExist {
+			return nil
+		}
+		return err
+	}
+	_, err = e.srv.history.Record(t, pos)
+	return err
+}
+
 func (e *event) OnXID(eventHeader *replication.EventHeader, nextPos mysql.Position) error {
 	return nil
 }
 
 func (e *event) OnRow(rowsEvent *canal.RowsEvent) error {
+	// 按该行所在位点生效的表结构解析, 没有历史时以当前表结构作为初始版本
+	// 首次启动时 mysqldump 导出的行没有 Header, 使用导出时记录的位点
+	dump := rowsEvent.Header == nil
+	var pos mysql.Position
+	if dump {
+		pos = e.srv.canal.SyncedPosition()
+	} else {
+		pos = mysql.Position{Name: e.file, Pos: rowsEvent.Header.LogPos}
+	}
+	version := e.srv.history.Lookup(rowsEvent.Table.Schema, rowsEvent.Table.Name, pos)
+	if version == nil {
+		var err error
+		if version, err = e.srv.history.Record(rowsEvent.Table, mysql.Position{}); err != nil {
+			return err
+		}
+	}
+
+	index := e.index
+	e.index++
 
 	for k, v := range rowsEvent.Rows {
 		// 更新会有两条记录，暂时只取更新后的那条数据
@@ -51,26 +182,56 @@ func (e *event) OnRow(rowsEvent *canal.RowsEvent) error {
 		}
 
 		// 识别列对应值
-		values := make(map[string]interface{}, 0)
-		for _, column := range rowsEvent.Table.Columns {
-			value, _ := rowsEvent.Table.GetColumnValue(column.Name, v)
-			values[column.Name] = value
+		values := version.decode(v)
+		var before map[string]interface{}
+		if rowsEvent.Action == canal.UpdateAction {
+			before = version.decode(rowsEvent.Rows[k-1])
 		}
 
 		// 转发给方法处理
+		record := fmt.Sprintf("%v", reflect.ValueOf(v[0]))
+		id := e.eventID(pos, index, k)
+		if dump {
+			id = dumpEventID(pos, rowsEvent.Table.Schema, rowsEvent.Table.Name, record)
+		}
 		valuesJson, _ := json.Marshal(values)
 		e.srv.syncCh <- bulkRequest{
-			Record: fmt.Sprintf("%v", reflect.ValueOf(v[0])),
-			Table:  rowsEvent.Table.Name,
-			Action: rowsEvent.Action,
-			Values: string(valuesJson),
+			Record:  record,
+			Schema:  rowsEvent.Table.Schema,
+			Table:   rowsEvent.Table.Name,
+			Action:  rowsEvent.Action,
+			Values:  string(valuesJson),
+			Data:    values,
+			Before:  before,
+			Version: version.Version,
+			GTID:    e.gtid,
+			ID:      id,
 		}
 	}
 
 	return e.srv.ctx.Err()
 }
 
+// eventID 有 GTID 时由 GTID、事务内行事件序号、行序号组成, 否则使用 binlog 文件、位点、行序号
+func (e *event) eventID(pos mysql.Position, index, row int) string {
+	if len(e.gtid) > 0 {
+		return fmt.Sprintf("%s:%d:%d", e.gtid, index, row)
+	}
+	return fmt.Sprintf("%s:%d:%d", pos.Name, pos.Pos, row)
+}
+
+// dumpEventID 导出的行没有位点, 由导出位点、表以及主键组成, 重新导出时不变
+func dumpEventID(pos mysql.Position, schema, table, record string) string {
+	return fmt.Sprintf("dump:%s:%d:%s.%s:%s", pos.Name, pos.Pos, schema, table, record)
+}
+
 func (e *event) OnGTID(eventHeader *replication.EventHeader, gtidEvent mysql.BinlogGTIDEvent) error {
+	gtid, err := gtidEvent.GTIDNext()
+	if err != nil {
+		return err
+	}
+	e.gtid = gtid.String()
+	e.index = 0
 	return nil
 }
 
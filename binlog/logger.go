@@ -62,7 +62,7 @@ func newLogger(level log.Level) loggers.Advanced {
 }
 
 func (l *logger) Debug(args ...interface{}) {
-	LogDebug(args)
+	LogDebug(args...)
 }
 
 func (l *logger) Debugf(format string, args ...interface{}) {
@@ -70,43 +70,43 @@ func (l *logger) Debugf(format string, args ...interface{}) {
 }
 
 func (l *logger) Debugln(args ...interface{}) {
-	LogDebug(args)
+	LogDebug(args...)
 }
 
 func (l *logger) Error(args ...interface{}) {
-	LogError(args)
+	LogError(args...)
 }
 
 func (l *logger) Errorf(format string, args ...interface{}) {
-	LogErrorf(format, args)
+	LogErrorf(format, args...)
 }
 
 func (l *logger) Errorln(args ...interface{}) {
-	LogError(args)
+	LogError(args...)
 }
 
 func (l *logger) Info(args ...interface{}) {
-	LogInfo(args)
+	LogInfo(args...)
 }
 
 func (l *logger) Infof(format string, args ...interface{}) {
-	LogInfof(format, args)
+	LogInfof(format, args...)
 }
 
 func (l *logger) Infoln(args ...interface{}) {
-	LogInfo(args)
+	LogInfo(args...)
 }
 
 func (l *logger) Warn(args ...interface{}) {
-	LogWarn(args)
+	LogWarn(args...)
 }
 
 func (l *logger) Warnf(format string, args ...interface{}) {
-	LogWarnf(format, args)
+	LogWarnf(format, args...)
 }
 
 func (l *logger) Warnln(args ...interface{}) {
-	LogWarn(args)
+	LogWarn(args...)
 }
 
 func (l *logger) Fatal(args ...interface{}) {
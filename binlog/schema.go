@@ -0,0 +1,297 @@
+package binlog
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/parser/ast"
+	"github.com/siddontang/go/ioutil2"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tableVersion 某个 binlog 位点开始生效的表结构
+type tableVersion struct {
+	Schema    string   `toml:"schema"`
+	Table     string   `toml:"table"`
+	Version   int      `toml:"version"`
+	Name      string   `toml:"name"` // 生效的 binlog 文件, 空表示从最早开始生效
+	Pos       uint32   `toml:"pos"`
+	Columns   []string `toml:"columns"`
+	PKColumns []int    `toml:"pk_columns"`
+}
+
+func (v *tableVersion) position() mysql.Position {
+	return mysql.Position{Name: v.Name, Pos: v.Pos}
+}
+
+// decode 按列名映射行数据
+func (v *tableVersion) decode(row []interface{}) map[string]interface{} {
+	values := make(map[string]interface{}, len(v.Columns))
+	for i, column := range v.Columns {
+		if i < len(row) {
+			values[column] = row[i]
+		}
+	}
+	return values
+}
+
+// alter 在该版本上应用 ALTER TABLE, 返回变更后的列以及主键
+// 只处理增删改列、主键以及不影响列的变更, 其他变更或与该版本不一致时返回 false
+func (v *tableVersion) alter(stmt *ast.AlterTableStmt) ([]string, []int, bool) {
+	columns := append([]string(nil), v.Columns...)
+	pk := make([]string, 0, len(v.PKColumns))
+	for _, i := range v.PKColumns {
+		if i >= len(columns) {
+			return nil, nil, false
+		}
+		pk = append(pk, columns[i])
+	}
+
+	index := func(name string) int {
+		for i, column := range columns {
+			if strings.EqualFold(column, name) {
+				return i
+			}
+		}
+		return -1
+	}
+	insert := func(name string, pos *ast.ColumnPosition) bool {
+		at := len(columns)
+		if pos != nil {
+			switch pos.Tp {
+			case ast.ColumnPositionFirst:
+				at = 0
+			case ast.ColumnPositionAfter:
+				if at = index(pos.RelativeColumn.Name.O) + 1; at == 0 {
+					return false
+				}
+			}
+		}
+		columns = append(columns[:at], append([]string{name}, columns[at:]...)...)
+		return true
+	}
+	rename := func(old, name string) {
+		for i := range pk {
+			if strings.EqualFold(pk[i], old) {
+				pk[i] = name
+			}
+		}
+	}
+
+	for _, spec := range stmt.Specs {
+		switch spec.Tp {
+		case ast.AlterTableAddColumns:
+			for _, column := range spec.NewColumns {
+				name := column.Name.Name.O
+				if index(name) >= 0 || !insert(name, spec.Position) {
+					return nil, nil, false
+				}
+				for _, option := range column.Options {
+					if option.Tp == ast.ColumnOptionPrimaryKey {
+						pk = []string{name}
+					}
+				}
+			}
+		case ast.AlterTableDropColumn:
+			i := index(spec.OldColumnName.Name.O)
+			if i < 0 {
+				return nil, nil, false
+			}
+			columns = append(columns[:i], columns[i+1:]...)
+			for j := range pk {
+				if strings.EqualFold(pk[j], spec.OldColumnName.Name.O) {
+					pk = append(pk[:j], pk[j+1:]...)
+					break
+				}
+			}
+		case ast.AlterTableModifyColumn, ast.AlterTableChangeColumn:
+			name := spec.NewColumns[0].Name.Name.O
+			old := name
+			if spec.Tp == ast.AlterTableChangeColumn {
+				old = spec.OldColumnName.Name.O
+			}
+			i := index(old)
+			if i < 0 {
+				return nil, nil, false
+			}
+			if spec.Position != nil && spec.Position.Tp != ast.ColumnPositionNone {
+				columns = append(columns[:i], columns[i+1:]...)
+				if !insert(name, spec.Position) {
+					return nil, nil, false
+				}
+			} else {
+				columns[i] = name
+			}
+			rename(old, name)
+		case ast.AlterTableRenameColumn:
+			i := index(spec.OldColumnName.Name.O)
+			if i < 0 {
+				return nil, nil, false
+			}
+			columns[i] = spec.NewColumnName.Name.O
+			rename(spec.OldColumnName.Name.O, spec.NewColumnName.Name.O)
+		case ast.AlterTableAddConstraint:
+			if spec.Constraint == nil || spec.Constraint.Tp != ast.ConstraintPrimaryKey {
+				continue
+			}
+			pk = pk[:0]
+			for _, key := range spec.Constraint.Keys {
+				if key.Column == nil {
+					return nil, nil, false
+				}
+				pk = append(pk, key.Column.Name.O)
+			}
+		case ast.AlterTableDropPrimaryKey:
+			pk = pk[:0]
+		case ast.AlterTableOption, ast.AlterTableDropIndex, ast.AlterTableDropForeignKey, ast.AlterTableAlterColumn,
+			ast.AlterTableLock, ast.AlterTableAlgorithm, ast.AlterTableRenameIndex, ast.AlterTableForce,
+			ast.AlterTableIndexInvisible, ast.AlterTableEnableKeys, ast.AlterTableDisableKeys,
+			ast.AlterTableAlterCheck, ast.AlterTableDropCheck:
+			// 不影响列
+		default:
+			return nil, nil, false
+		}
+	}
+
+	pkColumns := make([]int, 0, len(pk))
+	for _, name := range pk {
+		i := index(name)
+		if i < 0 {
+			return nil, nil, false
+		}
+		pkColumns = append(pkColumns, i)
+	}
+	return columns, pkColumns, true
+}
+
+// schemaHistory 表结构历史, 与同步点保存在同一目录
+// canal 只保留当前表结构, 回放 ALTER 之前的 binlog 时需要按位点取对应版本
+type schemaHistory struct {
+	sync.RWMutex
+
+	Tables []*tableVersion `toml:"tables"`
+
+	filePath string
+	versions map[string][]*tableVersion
+}
+
+func schemaKey(db, table string) string {
+	return fmt.Sprintf("%s.%s", db, table)
+}
+
+func loadSchemaHistory(dataDir string) (*schemaHistory, error) {
+	h := &schemaHistory{versions: make(map[string][]*tableVersion)}
+	if len(dataDir) == 0 {
+		return h, nil
+	}
+	h.filePath = path.Join(dataDir, ".schema.history")
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	f, err := os.Open(h.filePath)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Trace(err)
+	} else if os.IsNotExist(errors.Cause(err)) {
+		return h, nil
+	}
+	defer f.Close()
+	if _, err = toml.DecodeReader(f, h); err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, v := range h.Tables {
+		key := schemaKey(v.Schema, v.Table)
+		h.versions[key] = append(h.versions[key], v)
+	}
+	for _, versions := range h.versions {
+		sortVersions(versions)
+	}
+	return h, nil
+}
+
+// Lookup 返回在 pos 位点生效的表结构, 没有记录时返回 nil
+func (h *schemaHistory) Lookup(db, table string, pos mysql.Position) *tableVersion {
+	h.RLock()
+	defer h.RUnlock()
+
+	versions := h.versions[schemaKey(db, table)]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].position().Compare(pos) <= 0 {
+			return versions[i]
+		}
+	}
+	return nil
+}
+
+// Record 记录在 pos 位点开始生效的表结构
+// 同一位点已有记录时(从同步点重放 DDL)直接返回已有版本
+func (h *schemaHistory) Record(t *schema.Table, pos mysql.Position) (*tableVersion, error) {
+	columns := make([]string, 0, len(t.Columns))
+	for _, column := range t.Columns {
+		columns = append(columns, column.Name)
+	}
+	return h.RecordColumns(t.Schema, t.Name, columns, t.PKColumns, pos)
+}
+
+// RecordColumns 按列名以及主键列序号记录在 pos 位点开始生效的表结构
+func (h *schemaHistory) RecordColumns(db, table string, columns []string, pkColumns []int, pos mysql.Position) (*tableVersion, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	key := schemaKey(db, table)
+	versions := h.versions[key]
+	for _, v := range versions {
+		if v.position().Compare(pos) == 0 {
+			return v, nil
+		}
+	}
+
+	v := &tableVersion{
+		Schema:    db,
+		Table:     table,
+		Version:   1,
+		Name:      pos.Name,
+		Pos:       pos.Pos,
+		Columns:   columns,
+		PKColumns: pkColumns,
+	}
+	for _, exist := range versions {
+		if exist.Version >= v.Version {
+			v.Version = exist.Version + 1
+		}
+	}
+	h.versions[key] = append(versions, v)
+	sortVersions(h.versions[key])
+	h.Tables = append(h.Tables, v)
+
+	return v, h.save()
+}
+
+// 按生效位点排序
+func sortVersions(versions []*tableVersion) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].position().Compare(versions[j].position()) < 0
+	})
+}
+
+func (h *schemaHistory) save() error {
+	if len(h.filePath) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(h); err != nil {
+		return errors.Trace(err)
+	}
+	err := ioutil2.WriteFileAtomic(h.filePath, buf.Bytes(), 0644)
+	if err != nil {
+		log.Errorf("canal save schema history to file %s err %v", h.filePath, err)
+	}
+	return errors.Trace(err)
+}
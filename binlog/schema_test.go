@@ -0,0 +1,131 @@
+package binlog
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/pingcap/tidb/pkg/parser"
+	"github.com/pingcap/tidb/pkg/parser/ast"
+)
+
+func testTable(columns ...string) *schema.Table {
+	t := &schema.Table{Schema: "db", Name: "user", PKColumns: []int{0}}
+	for _, c := range columns {
+		t.Columns = append(t.Columns, schema.TableColumn{Name: c})
+	}
+	return t
+}
+
+func parseAlter(t *testing.T, sql string) *ast.AlterTableStmt {
+	t.Helper()
+	stmts, _, err := parser.New().Parse(sql, "", "")
+	if err != nil {
+		t.Fatalf("parse %s: %v", sql, err)
+	}
+	stmt, ok := stmts[0].(*ast.AlterTableStmt)
+	if !ok {
+		t.Fatalf("%s is not ALTER TABLE", sql)
+	}
+	return stmt
+}
+
+// 按位点取生效的版本, 同一位点重复记录时返回已有版本, 重新加载后保持不变
+func TestSchemaHistoryRecordLookup(t *testing.T) {
+	dir := t.TempDir()
+	h, err := loadSchemaHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := h.Lookup("db", "user", mysql.Position{Name: "mysql-bin.000001", Pos: 4}); v != nil {
+		t.Fatalf("lookup without history = %+v, want nil", v)
+	}
+	v1, err := h.Record(testTable("id", "name"), mysql.Position{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alterAt := mysql.Position{Name: "mysql-bin.000002", Pos: 100}
+	v2, err := h.Record(testTable("id", "name", "age"), alterAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := h.Record(testTable("id", "other"), alterAt); again != v2 {
+		t.Fatalf("record at the same position = %+v, want %+v", again, v2)
+	}
+	if v1.Version != 1 || v2.Version != 2 {
+		t.Fatalf("versions = %d, %d, want 1, 2", v1.Version, v2.Version)
+	}
+
+	reloaded, err := loadSchemaHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		pos  mysql.Position
+		want int
+	}{
+		{mysql.Position{Name: "mysql-bin.000001", Pos: 500}, 1},
+		{mysql.Position{Name: "mysql-bin.000002", Pos: 99}, 1},
+		{alterAt, 2},
+		{mysql.Position{Name: "mysql-bin.000003", Pos: 4}, 2},
+	} {
+		for _, history := range []*schemaHistory{h, reloaded} {
+			v := history.Lookup("db", "user", c.pos)
+			if v == nil || v.Version != c.want {
+				t.Errorf("lookup %s = %+v, want version %d", c.pos, v, c.want)
+			}
+		}
+	}
+}
+
+func TestTableVersionDecode(t *testing.T) {
+	v := &tableVersion{Columns: []string{"id", "name", "age"}}
+	got := v.decode([]interface{}{1, "tom"})
+	want := map[string]interface{}{"id": 1, "name": "tom"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("decode = %v, want %v", got, want)
+	}
+}
+
+// 连续的 ALTER 依次应用到之前的版本上
+func TestTableVersionAlter(t *testing.T) {
+	v := &tableVersion{Columns: []string{"id", "name", "age"}, PKColumns: []int{0}}
+	steps := []struct {
+		sql     string
+		columns []string
+		pk      []int
+	}{
+		{"ALTER TABLE user ADD COLUMN email varchar(64) NOT NULL DEFAULT '' AFTER name", []string{"id", "name", "email", "age"}, []int{0}},
+		{"ALTER TABLE user DROP COLUMN age, ADD INDEX idx_email (email)", []string{"id", "name", "email"}, []int{0}},
+		{"ALTER TABLE user CHANGE name nick varchar(32) FIRST", []string{"nick", "id", "email"}, []int{1}},
+		{"ALTER TABLE user RENAME COLUMN email TO mail, MODIFY id bigint AFTER mail", []string{"nick", "mail", "id"}, []int{2}},
+		{"ALTER TABLE user DROP PRIMARY KEY, ADD PRIMARY KEY (id, nick)", []string{"nick", "mail", "id"}, []int{2, 0}},
+	}
+	for _, step := range steps {
+		columns, pk, ok := v.alter(parseAlter(t, step.sql))
+		if !ok {
+			t.Fatalf("alter %s failed", step.sql)
+		}
+		if !reflect.DeepEqual(columns, step.columns) || !reflect.DeepEqual(pk, step.pk) {
+			t.Fatalf("alter %s = %v %v, want %v %v", step.sql, columns, pk, step.columns, step.pk)
+		}
+		v = &tableVersion{Columns: columns, PKColumns: pk}
+	}
+}
+
+// 与版本不一致或无法推断的变更返回 false
+func TestTableVersionAlterUnsupported(t *testing.T) {
+	v := &tableVersion{Columns: []string{"id", "name"}, PKColumns: []int{0}}
+	for _, sql := range []string{
+		"ALTER TABLE user ADD COLUMN name int",
+		"ALTER TABLE user DROP COLUMN age",
+		"ALTER TABLE user ADD COLUMN age int AFTER missing",
+		"ALTER TABLE user RENAME TO member",
+	} {
+		if _, _, ok := v.alter(parseAlter(t, sql)); ok {
+			t.Errorf("alter %s ok, want false", sql)
+		}
+	}
+}
@@ -8,10 +8,15 @@ import (
 	"github.com/go-mysql-org/go-mysql/canal"
 	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/pingcap/errors"
+	"github.com/tonyhal/hercules/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"path/filepath"
 	"reflect"
 	"regexp"
 	"sync"
+	"sync/atomic"
 )
 
 var _ transport.Server = (*Server)(nil)
@@ -35,11 +40,31 @@ type Server struct {
 	err     error
 	handler map[string]*handler
 	master  *master
+	history *schemaHistory
 	conf    *config
+
+	flushers []Flusher
+	inflight sync.WaitGroup // 已分发未处理完成的行变更, 保存同步点前等待
+	failed   atomic.Value   // 首次处理失败的 failure, 之后停止同步且不再保存同步点
+}
+
+// failure 以固定类型保存到 atomic.Value
+type failure struct {
+	err error
 }
 
+// Flusher 缓冲写入的处理方法, 保存同步点前调用, 失败时不保存同步点
+type Flusher interface {
+	Flush() error
+}
+
+// EventHandle 行变更处理方法, 通过 Event.Context 获取 context
+// 同一个表的变更按顺序处理, 返回错误时停止同步, 不保存之后的同步点
+type EventHandle func(*Event) error
+
 type handler struct {
 	f interface{}
+	e EventHandle
 }
 
 type ServerOption func(*Server)
@@ -80,8 +105,12 @@ func (s *Server) Run() error {
 	}
 
 	log.Infof("[%s] server starting. [%v]", s.Name(), s.master.GtidSet())
-	if err := s.canal.StartFromGTID(gtidSet); err != nil {
-
+	err = s.canal.StartFromGTID(gtidSet)
+	// 处理失败时停止同步, 返回失败原因
+	if f, ok := s.failed.Load().(failure); ok {
+		return f.err
+	}
+	if err != nil {
 		return errors.Trace(err)
 	}
 
@@ -91,22 +120,38 @@ func (s *Server) Run() error {
 func (s *Server) syncLoop() {
 	defer s.wg.Done()
 
+	// 每个表一个协程按顺序处理, 同一行的变更不会乱序
+	queues := make(map[string]chan bulkRequest)
+	defer func() {
+		for _, q := range queues {
+			close(q)
+		}
+	}()
 	for {
 		select {
 		case ch := <-s.syncCh:
 			switch v := ch.(type) {
 			case gtidSetSaver:
+				// 等待之前的行变更处理完成, 处理失败或缓冲写入失败时不保存, 重启后从上次保存的同步点重放
+				s.inflight.Wait()
+				if err := s.checkpoint(); err != nil {
+					log.Errorf("[%s] skip saving sync position %v: %v", s.Name(), v.GtidSet, err)
+					s.fail(err)
+					continue
+				}
 				if err := s.master.Save(v.GtidSet); err != nil {
 					log.Errorf("save sync position %v err %v, close sync.\n", v.GtidSet, err)
 				}
 			case bulkRequest:
-				go func(v bulkRequest) {
-					// 处理分表
-					table := regexp.MustCompile(`_\d{6}$`).ReplaceAllString(v.Table, "")
-					if h, ok := s.handler[table]; ok {
-						reflect.ValueOf(h.f).Call([]reflect.Value{reflect.ValueOf(v.Record), reflect.ValueOf(v.Action), reflect.ValueOf(v.Table), reflect.ValueOf(v.Values)})
-					}
-				}(v)
+				key := v.Schema + "." + v.Table
+				q, ok := queues[key]
+				if !ok {
+					q = make(chan bulkRequest, 1024)
+					queues[key] = q
+					go s.worker(q)
+				}
+				s.inflight.Add(1)
+				q <- v
 			}
 		case <-s.ctx.Done():
 			return
@@ -114,17 +159,96 @@ func (s *Server) syncLoop() {
 	}
 }
 
+// worker 按顺序处理一个表的行变更
+func (s *Server) worker(q <-chan bulkRequest) {
+	for v := range q {
+		s.dispatch(v)
+		s.inflight.Done()
+	}
+}
+
+// fail 记录首次失败并停止同步, Start 返回该错误
+func (s *Server) fail(err error) {
+	if !s.failed.CompareAndSwap(nil, failure{err}) {
+		return
+	}
+	log.Errorf("[%s] stop syncing after failure: %v", s.Name(), err)
+	go s.canal.Close()
+}
+
+// checkpoint 保存同步点前写入缓冲的数据, 之前有处理失败时返回错误
+func (s *Server) checkpoint() error {
+	if f, ok := s.failed.Load().(failure); ok {
+		return f.err
+	}
+	for _, f := range s.flushers {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dispatch 交给表注册的方法处理, 每个事件携带由服务 context 派生的 span
+func (s *Server) dispatch(v bulkRequest) {
+	// 处理分表
+	table := regexp.MustCompile(`_\d{6}$`).ReplaceAllString(v.Table, "")
+	h, ok := s.handler[table]
+	if !ok {
+		return
+	}
+
+	ctx, span := tracing.Tracer(s.Name()).Start(s.ctx, fmt.Sprintf("binlog %s %s", v.Table, v.Action),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("binlog.schema", v.Schema),
+			attribute.String("binlog.table", v.Table),
+			attribute.String("binlog.action", v.Action),
+			attribute.String("binlog.gtid", v.GTID),
+		),
+	)
+	defer span.End()
+
+	if h.e == nil {
+		reflect.ValueOf(h.f).Call([]reflect.Value{reflect.ValueOf(v.Record), reflect.ValueOf(v.Action), reflect.ValueOf(v.Table), reflect.ValueOf(v.Values)})
+		return
+	}
+	ev := &Event{
+		Record:  v.Record,
+		Schema:  v.Schema,
+		Table:   v.Table,
+		Action:  v.Action,
+		Values:  v.Data,
+		Before:  v.Before,
+		Version: v.Version,
+		GTID:    v.GTID,
+		ID:      v.ID,
+		ctx:     ctx,
+	}
+	if err := h.e(ev); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		log.Errorf("[%s] handle %s.%s %s err %v", s.Name(), v.Schema, v.Table, v.Action, err)
+		s.fail(err)
+	}
+}
+
 func (s *Server) Start(ctx context.Context) (err error) {
 	if s.err != nil {
 		return s.err
 	}
-	s.ctx = ctx
+	// 停止时取消, 处理方法中的调用随之结束
+	s.ctx, s.cancel = context.WithCancel(ctx)
 
 	// 加载binlog文件同步点
 	filePath, _ := filepath.Abs(s.conf.filepath)
 	if s.master, err = loadMasterInfo(filePath); err != nil {
 		return errors.Trace(err)
 	}
+	// 加载表结构历史
+	if s.history, err = loadSchemaHistory(filePath); err != nil {
+		return errors.Trace(err)
+	}
 
 	tables := []string{}
 	for k, _ := range s.handler {
@@ -147,7 +271,18 @@ func (s *Server) Start(ctx context.Context) (err error) {
 		log.Errorf("failed opening connection to binlog: %v", s.err)
 		return errors.Trace(err)
 	}
-	s.canal.SetEventHandler(&event{s})
+	s.canal.SetEventHandler(&event{srv: s})
+	// 记录启动时的表结构, 作为没有历史时的初始版本
+	for _, table := range tables {
+		t, err := s.canal.GetTable(s.conf.db, table)
+		if err != nil {
+			log.Warnf("[%s] load table %s.%s schema err %v", s.Name(), s.conf.db, table, err)
+			continue
+		}
+		if _, err = s.history.Record(t, mysql.Position{}); err != nil {
+			return errors.Trace(err)
+		}
+	}
 	// 启动
 	return s.Run()
 }
@@ -155,17 +290,44 @@ func (s *Server) Start(ctx context.Context) (err error) {
 func (s *Server) Stop(_ context.Context) error {
 	defer log.Infof("[%s] server stopping.", s.Name())
 
+	s.cancel()
 	s.master.Close()
 	s.canal.Close()
 
 	return nil
 }
 
+// Register 注册表的处理方法
+// 支持 EventHandle、func(context.Context, *Event) error、带 Handle(*Event) error 方法的对象(如 BulkSink)
+// 以及 func(record, action, table, values string), 对象同时实现 Flusher 时保存同步点前调用 Flush
 func (s *Server) Register(t string, f interface{}) (err error) {
-	if reflect.TypeOf(f).Kind() == reflect.Func {
-		s.handler[t] = &handler{f: f}
-	} else {
-		err = fmt.Errorf("must be function")
+	switch h := f.(type) {
+	case interface{ Handle(*Event) error }:
+		s.handler[t] = &handler{f: f, e: h.Handle}
+		if flusher, ok := f.(Flusher); ok {
+			s.addFlusher(flusher)
+		}
+	case EventHandle:
+		s.handler[t] = &handler{f: f, e: h}
+	case func(*Event) error:
+		s.handler[t] = &handler{f: f, e: h}
+	case func(context.Context, *Event) error:
+		s.handler[t] = &handler{f: f, e: func(ev *Event) error { return h(ev.Context(), ev) }}
+	default:
+		if reflect.TypeOf(f).Kind() == reflect.Func {
+			s.handler[t] = &handler{f: f}
+		} else {
+			err = fmt.Errorf("must be function")
+		}
 	}
 	return
 }
+
+func (s *Server) addFlusher(f Flusher) {
+	for _, exist := range s.flushers {
+		if exist == f {
+			return
+		}
+	}
+	s.flushers = append(s.flushers, f)
+}
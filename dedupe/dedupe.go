@@ -0,0 +1,190 @@
+package dedupe
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"sync"
+	"time"
+)
+
+// Store 记录已处理的ID, binlog 事件以及 rabbitmq 消息共用
+// ttl 为 0 时记录不过期
+type Store interface {
+	// Seen 是否已处理
+	Seen(ctx context.Context, id string) (bool, error)
+	// Mark 标记已处理
+	Mark(ctx context.Context, id string) error
+}
+
+const (
+	// NewMemory 的 size 不大于 0 时保留的ID数
+	defaultMemorySize = 10000
+	// MySQL 去重表ID列的长度, 更长的ID使用 sha256 摘要
+	maxRecordID = 64
+)
+
+// memoryStore 进程内去重, 按 LRU 保留最近的ID
+type memoryStore struct {
+	sync.Mutex
+
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type memoryEntry struct {
+	id       string
+	expireAt time.Time
+}
+
+// NewMemory 进程内去重, 最多保留 size 个ID, 超过 ttl 后失效, 重启后失效
+// size 不大于 0 时保留 10000 个
+func NewMemory(size int, ttl time.Duration) Store {
+	if size <= 0 {
+		size = defaultMemorySize
+	}
+	return &memoryStore{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (m *memoryStore) Seen(_ context.Context, id string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	e, ok := m.items[id]
+	if !ok {
+		return false, nil
+	}
+	if entry := e.Value.(*memoryEntry); m.ttl > 0 && time.Now().After(entry.expireAt) {
+		m.ll.Remove(e)
+		delete(m.items, id)
+		return false, nil
+	}
+	m.ll.MoveToFront(e)
+	return true, nil
+}
+
+func (m *memoryStore) Mark(_ context.Context, id string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	expireAt := time.Now().Add(m.ttl)
+	if e, ok := m.items[id]; ok {
+		e.Value.(*memoryEntry).expireAt = expireAt
+		m.ll.MoveToFront(e)
+		return nil
+	}
+	m.items[id] = m.ll.PushFront(&memoryEntry{id: id, expireAt: expireAt})
+	for m.ll.Len() > m.size {
+		e := m.ll.Back()
+		m.ll.Remove(e)
+		delete(m.items, e.Value.(*memoryEntry).id)
+	}
+	return nil
+}
+
+// redisStore 使用 Redis 去重
+type redisStore struct {
+	client redis.UniversalClient
+	prefix string
+	ttl    time.Duration
+}
+
+// NewRedis Redis 去重, key 为 prefix + ID, 保留 ttl 时间
+func NewRedis(client redis.UniversalClient, prefix string, ttl time.Duration) Store {
+	return &redisStore{client: client, prefix: prefix, ttl: ttl}
+}
+
+func (r *redisStore) Seen(ctx context.Context, id string) (bool, error) {
+	n, err := r.client.Exists(ctx, r.prefix+id).Result()
+	return n > 0, err
+}
+
+func (r *redisStore) Mark(ctx context.Context, id string) error {
+	return r.client.Set(ctx, r.prefix+id, 1, r.ttl).Err()
+}
+
+// Record MySQL 去重表中已处理的ID, ExpireAt 为空时不过期
+// 超过 64 个字符的ID(如 binlog 全量导出的事件ID)保存为 sha256 摘要
+type Record struct {
+	ID       string     `gorm:"primaryKey;size:64"`
+	ExpireAt *time.Time `gorm:"index"`
+}
+
+func (Record) TableName() string {
+	return "dedupe_record"
+}
+
+// mysqlStore 使用 MySQL 去重, 过期的记录在标记时定期清理
+type mysqlStore struct {
+	sync.Mutex
+
+	db      *gorm.DB
+	ttl     time.Duration
+	purgeAt time.Time
+}
+
+// NewMySQL MySQL 去重, 保留 ttl 时间, 创建时自动建表
+func NewMySQL(db *gorm.DB, ttl time.Duration) (Store, error) {
+	if err := db.AutoMigrate(&Record{}); err != nil {
+		return nil, err
+	}
+	return &mysqlStore{db: db, ttl: ttl}, nil
+}
+
+// recordID 去重表中的ID
+func recordID(id string) string {
+	if len(id) <= maxRecordID {
+		return id
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *mysqlStore) Seen(ctx context.Context, id string) (bool, error) {
+	var count int64
+	err := m.db.WithContext(ctx).Model(&Record{}).
+		Where("id = ? AND (expire_at IS NULL OR expire_at > ?)", recordID(id), time.Now()).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func (m *mysqlStore) Mark(ctx context.Context, id string) error {
+	now := time.Now()
+	record := &Record{ID: recordID(id)}
+	if m.ttl > 0 {
+		expireAt := now.Add(m.ttl)
+		record.ExpireAt = &expireAt
+	}
+	err := m.db.WithContext(ctx).Clauses(clause.OnConflict{
+		DoUpdates: clause.AssignmentColumns([]string{"expire_at"}),
+	}).Create(record).Error
+	if err != nil || m.ttl <= 0 {
+		return err
+	}
+
+	// 每个 ttl 周期清理一次过期记录
+	m.Lock()
+	purge := now.After(m.purgeAt)
+	if purge {
+		m.purgeAt = now.Add(m.ttl)
+	}
+	m.Unlock()
+	if purge {
+		if err := m.db.WithContext(ctx).Where("expire_at <= ?", now).Delete(&Record{}).Error; err != nil {
+			log.Warnf("[dedupe] purge expired records err %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package rabbitmq
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/rabbitmq/amqp091-go"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// 写入磁盘的消息重放失败超过该次数后转存, 不再重放
+const maxReplayAttempts = 3
+
+// pendingPublish 断线期间缓存的消息
+type pendingPublish struct {
+	ID         string             `json:"id"`
+	Exchange   string             `json:"exchange"`
+	RoutingKey string             `json:"routing_key"`
+	Publishing amqp091.Publishing `json:"-"`
+	Stored     storedPublishing   `json:"publishing"`
+	Attempts   int                `json:"attempts"` // 重放失败次数
+
+	future  *PublishFuture
+	spilled bool // 从磁盘读取
+}
+
+// offlineBuffer 断线期间的消息缓存, 内存满后追加写入磁盘
+// 重放中的磁盘消息保存在 producer.replay, 本批结束后删除, 进程中途退出时下次启动重放
+type offlineBuffer struct {
+	sync.Mutex
+
+	size       int
+	pending    []*pendingPublish
+	spilled    map[string]*PublishFuture // 写入磁盘的消息等待确认的 future, 只在本进程内有效
+	filePath   string
+	replayPath string
+	parkPath   string
+	replaying  bool // 本批重放的磁盘消息来自重放文件
+}
+
+func newOfflineBuffer(size int, dir string) *offlineBuffer {
+	b := &offlineBuffer{size: size, spilled: make(map[string]*PublishFuture)}
+	if len(dir) > 0 {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Errorf("rabbitmq create spill dir %s err %v", dir, err)
+		} else {
+			b.filePath = filepath.Join(dir, "producer.spill")
+			b.replayPath = filepath.Join(dir, "producer.replay")
+			b.parkPath = filepath.Join(dir, "producer.parked")
+		}
+	}
+	return b
+}
+
+// Put 缓存消息, size 为 0 或内存与磁盘都不可用时返回 false
+// 返回的 future 在重连后收到 broker 确认时完成, 写入磁盘的消息进程重启后同样会重放
+func (b *offlineBuffer) Put(exchange, routingKey string, publishing amqp091.Publishing) (*PublishFuture, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	// 不缓存时阻塞等待重连
+	if b.size <= 0 {
+		return nil, false
+	}
+	p := &pendingPublish{ID: newID(), Exchange: exchange, RoutingKey: routingKey, Publishing: publishing, future: newPendingFuture()}
+	if len(b.pending) < b.size {
+		b.pending = append(b.pending, p)
+		return p.future, true
+	}
+	if len(b.filePath) == 0 {
+		return nil, false
+	}
+	if err := b.append(b.filePath, p); err != nil {
+		log.Errorf("rabbitmq spill message to %s err %v", b.filePath, err)
+		return nil, false
+	}
+	b.spilled[p.ID] = p.future
+	return p.future, true
+}
+
+// Restore 一批重放结束后放回未完成的消息, 磁盘消息重新写入磁盘, 内存消息放回队首
+// 之后删除重放中的文件, 已确认以及已转存的消息不再重放
+func (b *offlineBuffer) Restore(pending []*pendingPublish) {
+	b.Lock()
+	defer b.Unlock()
+	defer func() {
+		if !b.replaying {
+			return
+		}
+		b.replaying = false
+		if err := os.Remove(b.replayPath); err != nil && !os.IsNotExist(err) {
+			log.Errorf("rabbitmq remove replay file %s err %v", b.replayPath, err)
+		}
+	}()
+
+	var memory []*pendingPublish
+	for _, p := range pending {
+		if !p.spilled || len(b.filePath) == 0 {
+			memory = append(memory, p)
+			continue
+		}
+		if err := b.append(b.filePath, p); err != nil {
+			log.Errorf("rabbitmq spill message to %s err %v", b.filePath, err)
+			memory = append(memory, p)
+			continue
+		}
+		if p.future != nil {
+			b.spilled[p.ID] = p.future
+		}
+	}
+	b.pending = append(memory, b.pending...)
+}
+
+// Park 转存多次重放失败的磁盘消息, 需要人工处理
+func (b *offlineBuffer) Park(p *pendingPublish, cause error) {
+	b.Lock()
+	defer b.Unlock()
+
+	log.Errorf("rabbitmq park message %s after %d replay attempts: %v", p.Publishing.MessageId, p.Attempts, cause)
+	if len(b.parkPath) > 0 {
+		if err := b.append(b.parkPath, p); err != nil {
+			log.Errorf("rabbitmq park message to %s err %v", b.parkPath, err)
+		}
+	}
+	if p.future != nil {
+		p.future.complete(0, cause)
+	}
+}
+
+func (b *offlineBuffer) append(path string, p *pendingPublish) error {
+	line, err := encodePending(p)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(line); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func encodePending(p *pendingPublish) ([]byte, error) {
+	p.Stored = newStoredPublishing(p.Publishing)
+	line, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// Take 取出全部缓存, 先内存后磁盘
+// 磁盘消息连同上次未完成的重放一起写入重放文件后再删除缓存文件, 重放结束前进程退出不会丢失
+func (b *offlineBuffer) Take() []*pendingPublish {
+	b.Lock()
+	defer b.Unlock()
+
+	pending := b.pending
+	b.pending = nil
+	if len(b.filePath) == 0 {
+		return pending
+	}
+
+	spilled, err := b.read(b.replayPath)
+	if err != nil {
+		// 重放文件无法读取时保留缓存文件, 下次再试
+		log.Errorf("rabbitmq read replay file %s err %v", b.replayPath, err)
+		return pending
+	}
+	fresh, err := b.read(b.filePath)
+	if err != nil {
+		log.Errorf("rabbitmq read spill file %s err %v", b.filePath, err)
+		b.replaying = len(spilled) > 0
+		return append(pending, spilled...)
+	}
+	spilled = append(spilled, fresh...)
+	if len(spilled) == 0 {
+		return pending
+	}
+	if len(fresh) > 0 {
+		if err = b.rewrite(b.replayPath, spilled); err != nil {
+			// 重放文件写入失败时只重放上次未完成的消息, 缓存文件保留
+			log.Errorf("rabbitmq write replay file %s err %v", b.replayPath, err)
+			spilled = spilled[:len(spilled)-len(fresh)]
+			b.replaying = len(spilled) > 0
+			return append(pending, spilled...)
+		}
+		if err = os.Remove(b.filePath); err != nil {
+			log.Errorf("rabbitmq remove spill file %s err %v", b.filePath, err)
+		}
+	}
+
+	b.replaying = true
+	for _, p := range spilled {
+		// 上次进程写入的消息没有 future
+		if future, ok := b.spilled[p.ID]; ok && len(p.ID) > 0 {
+			p.future = future
+			delete(b.spilled, p.ID)
+		}
+	}
+	return append(pending, spilled...)
+}
+
+// read 读取磁盘中的消息, 文件不存在时返回空
+func (b *offlineBuffer) read(path string) ([]*pendingPublish, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var pending []*pendingPublish
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		p := new(pendingPublish)
+		if err = json.Unmarshal(scanner.Bytes(), p); err != nil {
+			log.Errorf("rabbitmq decode spilled message err %v", err)
+			continue
+		}
+		p.Publishing = p.Stored.publishing()
+		p.spilled = true
+		pending = append(pending, p)
+	}
+	return pending, scanner.Err()
+}
+
+// rewrite 写入临时文件后替换 path
+func (b *offlineBuffer) rewrite(path string, pending []*pendingPublish) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, p := range pending {
+		line, err := encodePending(p)
+		if err != nil {
+			log.Errorf("rabbitmq encode spilled message %s err %v", p.ID, err)
+			continue
+		}
+		if _, err = w.Write(line); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Close 以 err 结束所有等待中的 future, 内存中的消息丢弃, 磁盘中的消息保留到下次启动重放
+func (b *offlineBuffer) Close(err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, p := range b.pending {
+		p.future.complete(0, err)
+	}
+	b.pending = nil
+	for id, future := range b.spilled {
+		future.complete(0, err)
+		delete(b.spilled, id)
+	}
+}
@@ -0,0 +1,120 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-kratos/kratos/v2/encoding"
+	_ "github.com/go-kratos/kratos/v2/encoding/json"
+	_ "github.com/go-kratos/kratos/v2/encoding/proto"
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/vmihailenco/msgpack/v5"
+	"reflect"
+	"strings"
+)
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeMsgpack  = "application/x-msgpack"
+)
+
+var (
+	ErrUnsupportedContentType = errors.New("rabbitmq: unsupported content type")
+	// ErrUndecodable 消息无法解码, 不再重试直接转入死信队列
+	ErrUndecodable = errors.New("rabbitmq: undecodable message")
+)
+
+// RegisterMsgpackCodec 将 msgpack 编解码注册到 kratos encoding, 使用 application/x-msgpack 前调用
+// 会覆盖已注册的同名编解码, 因此不在导入时自动注册
+func RegisterMsgpackCodec() {
+	encoding.RegisterCodec(msgpackCodec{})
+}
+
+// msgpackCodec kratos encoding 的 msgpack 编解码
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+// CodecForContentType 按 content type 选择 kratos encoding 中注册的编解码
+// application/json、application/x-protobuf 等, 为空时使用 JSON; application/x-msgpack 需先调用 RegisterMsgpackCodec
+// Producer.Publish 默认的 text/plain 按 JSON 解码, 兼容已有的生产者
+func CodecForContentType(contentType string) (encoding.Codec, error) {
+	if len(contentType) == 0 {
+		contentType = ContentTypeJSON
+	}
+	subtype := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	if i := strings.LastIndex(subtype, "/"); i >= 0 {
+		subtype = subtype[i+1:]
+	}
+	subtype = strings.TrimPrefix(strings.ToLower(subtype), "x-")
+	switch subtype {
+	case "plain":
+		subtype = "json"
+	case "protobuf":
+		subtype = "proto"
+	case "vnd.msgpack":
+		subtype = "msgpack"
+	}
+	if codec := encoding.GetCodec(subtype); codec != nil {
+		return codec, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedContentType, contentType)
+}
+
+// Publish 按 content type 编码后推送并等待确认, 默认 application/json
+func Publish[T any](ctx context.Context, producer *Producer, exchange, routingKey string, v T, opts ...PublishOption) error {
+	publishing := amqp091.Publishing{ContentType: ContentTypeJSON}
+	for _, o := range opts {
+		o(&publishing)
+	}
+	codec, err := CodecForContentType(publishing.ContentType)
+	if err != nil {
+		return err
+	}
+	body, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return producer.PublishWithContext(ctx, exchange, routingKey, body, append(opts, WithContentType(publishing.ContentType))...)
+}
+
+// Decode 按消息的 content type 解码, 失败时返回 ErrUndecodable
+func Decode[T any](msg Message) (T, error) {
+	var v T
+	codec, err := CodecForContentType(msg.ContentType())
+	if err != nil {
+		return v, fmt.Errorf("%w: %v", ErrUndecodable, err)
+	}
+	// 指针类型(如 protobuf 消息)分配后直接解码
+	target := interface{}(&v)
+	if t := reflect.TypeOf(v); t != nil && t.Kind() == reflect.Ptr {
+		v = reflect.New(t.Elem()).Interface().(T)
+		target = v
+	}
+	if err = codec.Unmarshal(msg.Value(), target); err != nil {
+		return v, fmt.Errorf("%w: %v", ErrUndecodable, err)
+	}
+	return v, nil
+}
+
+// Handle 解码消息后调用 h, 无法解码的消息不再重试
+func Handle[T any](h func(context.Context, T) error) ConsumerHandle {
+	return func(ctx context.Context, msg Message) error {
+		v, err := Decode[T](msg)
+		if err != nil {
+			return err
+		}
+		return h(ctx, v)
+	}
+}
@@ -0,0 +1,86 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// 默认等待确认的时间
+const defaultConfirmTimeout = 10 * time.Second
+
+var (
+	ErrNack           = errors.New("rabbitmq: message nacked by broker")
+	ErrConfirmTimeout = errors.New("rabbitmq: publish confirm timeout")
+)
+
+// PublishFuture 异步推送的结果, 收到 broker 确认、拒绝或超时后完成
+type PublishFuture struct {
+	once sync.Once
+	tag  uint64
+	err  error
+	done chan struct{}
+}
+
+func newPendingFuture() *PublishFuture {
+	return &PublishFuture{done: make(chan struct{})}
+}
+
+// 推送阶段就失败的结果
+func failedPublishFuture(err error) *PublishFuture {
+	f := newPendingFuture()
+	f.complete(0, err)
+	return f
+}
+
+func (f *PublishFuture) complete(tag uint64, err error) {
+	f.once.Do(func() {
+		f.tag = tag
+		f.err = err
+		close(f.done)
+	})
+}
+
+// DeliveryTag 通道内的投递序号, 完成后有效
+func (f *PublishFuture) DeliveryTag() uint64 {
+	select {
+	case <-f.done:
+		return f.tag
+	default:
+		return 0
+	}
+}
+
+// Done 完成后关闭
+func (f *PublishFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err 完成前返回 nil
+func (f *PublishFuture) Err() error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+// Wait 等待结果, ctx 结束时返回 ctx 的错误
+func (f *PublishFuture) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Then 完成后回调
+func (f *PublishFuture) Then(callback func(error)) {
+	go func() {
+		<-f.done
+		callback(f.err)
+	}()
+}
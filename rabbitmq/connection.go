@@ -0,0 +1,128 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/rabbitmq/amqp091-go"
+	"sync"
+	"time"
+)
+
+const (
+	// 重连间隔, 每次失败翻倍
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// backoff 第 attempt 次重试前的等待时间
+func backoff(attempt int) time.Duration {
+	d := minBackoff
+	for i := 0; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// connection 断线后自动重连的连接
+type connection struct {
+	sync.RWMutex
+
+	identity string
+	source   string
+	conn     *amqp091.Connection
+	ready    chan struct{} // 连接可用时关闭, 断开时重新创建
+}
+
+func newConnection(identity, source string) *connection {
+	return &connection{
+		identity: identity,
+		source:   source,
+		ready:    make(chan struct{}),
+	}
+}
+
+func (c *connection) dial() error {
+	conn, err := amqp091.Dial(c.source)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	c.conn = conn
+	close(c.ready)
+	c.Unlock()
+	return nil
+}
+
+func (c *connection) connState() (string, string, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	return "server", c.identity, c.conn != nil && !c.conn.IsClosed()
+}
+
+// watch 监听连接关闭并按退避重连, ctx 结束时关闭连接
+func (c *connection) watch(ctx context.Context) {
+	for {
+		c.RLock()
+		conn := c.conn
+		c.RUnlock()
+
+		notify := conn.NotifyClose(make(chan *amqp091.Error, 1))
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			return
+		case err := <-notify:
+			log.Warnf("rabbitmq connection %s closed: %v, reconnecting", c.identity, err)
+		}
+
+		c.Lock()
+		c.ready = make(chan struct{})
+		c.Unlock()
+
+		for attempt := 0; ; attempt++ {
+			select {
+			case <-time.After(backoff(attempt)):
+			case <-ctx.Done():
+				return
+			}
+			err := c.dial()
+			if err == nil {
+				log.Infof("rabbitmq connection %s recovered", c.identity)
+				metricReconnectTotal.WithLabelValues("server", c.identity).Inc()
+				break
+			}
+			log.Errorf("failed reconnecting to rabbitmq %s: %v", c.identity, err)
+		}
+	}
+}
+
+// Channel 等待连接可用后打开通道
+func (c *connection) Channel(ctx context.Context) (*amqp091.Channel, error) {
+	for {
+		c.RLock()
+		conn, ready := c.conn, c.ready
+		c.RUnlock()
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		ch, err := conn.Channel()
+		// 连接刚断开还未开始重连
+		if errors.Is(err, amqp091.ErrClosed) {
+			select {
+			case <-time.After(100 * time.Millisecond):
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		return ch, err
+	}
+}
@@ -1,13 +1,118 @@
 package rabbitmq
 
-import "context"
+import (
+	"context"
+	"github.com/go-kratos/kratos/v2/middleware"
+	"github.com/rabbitmq/amqp091-go"
+	"sync"
+	"time"
+)
 
 type ConsumerHandle func(context.Context, Message) error
 
 type Consumer struct {
-	Identity string
-	Exchange string
-	Queue    string
-	Handle   ConsumerHandle
-	Fork     int
+	Identity    string
+	Exchange    string
+	Queue       string
+	Handle      ConsumerHandle
+	Fork        int          // 通道数
+	Prefetch    int          // 每个通道的预取数量, 默认 1, 不少于 Concurrency
+	Concurrency int          // 每个通道同时处理的消息数, 默认 1
+	Retry       *RetryPolicy // 为空时失败的消息立即重新入队, 无法解码的消息转入 队列名.dlq, 首次出现时声明
+	Topology    *Topology    // 为空时按交换机名称推断类型, 以队列名绑定
+	Offset      StreamOffset // stream 队列开始消费的位置, 默认 next; 每个通道都收到全部消息, Fork 应为 1
+
+	// 中间件, 兼容 kratos 的 logging、metrics、tracing 等, 请求为 Message
+	// Handle 以及中间件 panic 时默认恢复, 按 ErrHandlerPanic 处理失败
+	Middleware []middleware.Middleware
+}
+
+// StreamOffset stream 队列的消费位置
+type StreamOffset struct {
+	value interface{}
+}
+
+var (
+	OffsetFirst = StreamOffset{value: "first"} // 最早保留的消息
+	OffsetLast  = StreamOffset{value: "last"}  // 最后一个 chunk
+	OffsetNext  = StreamOffset{value: "next"}  // 只消费新消息
+)
+
+// OffsetAt 从指定 offset 开始
+func OffsetAt(offset int64) StreamOffset {
+	return StreamOffset{value: offset}
+}
+
+// OffsetTimestamp 从指定时间之后的消息开始, 精度为秒
+func OffsetTimestamp(t time.Time) StreamOffset {
+	return StreamOffset{value: t}
+}
+
+func (o StreamOffset) args() amqp091.Table {
+	if o.value == nil {
+		return nil
+	}
+	return amqp091.Table{"x-stream-offset": o.value}
+}
+
+// streamOffset stream 队列投递的消息中的 offset
+func streamOffset(headers amqp091.Table) (int64, bool) {
+	switch v := headers["x-stream-offset"].(type) {
+	case int64:
+		return v, true
+	case int32:
+		return int64(v), true
+	case int:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// streamOffsets stream 队列中已接收以及已处理的 offset
+// 只有之前接收的消息都处理完成时才推进, 失败的消息之后的 offset 不再提交, 重新订阅时从失败处重放
+type streamOffsets struct {
+	sync.Mutex
+
+	committed int64          // 连续处理完成的最大 offset, -1 表示未处理
+	inflight  map[int64]bool // 已接收未提交的 offset, 值为是否处理完成
+}
+
+func newStreamOffsets() *streamOffsets {
+	return &streamOffsets{committed: -1, inflight: make(map[int64]bool)}
+}
+
+// receive 按接收顺序登记 offset
+func (o *streamOffsets) receive(offset int64) {
+	o.Lock()
+	o.inflight[offset] = false
+	o.Unlock()
+}
+
+// done 处理完成, 推进到连续完成的最大 offset
+func (o *streamOffsets) done(offset int64) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.inflight[offset] = true
+	for len(o.inflight) > 0 {
+		min := int64(-1)
+		for k := range o.inflight {
+			if min < 0 || k < min {
+				min = k
+			}
+		}
+		if !o.inflight[min] {
+			return
+		}
+		delete(o.inflight, min)
+		o.committed = min
+	}
+}
+
+// last 连续处理完成的最大 offset
+func (o *streamOffsets) last() int64 {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.committed
 }
@@ -0,0 +1,31 @@
+package rabbitmq
+
+import (
+	"context"
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/tonyhal/hercules/dedupe"
+)
+
+// Idempotent 跳过已处理的消息, 处理成功后记录消息ID, store 见 dedupe 包
+// 重新投递的消息直接确认, 没有消息ID的消息不去重
+// 同一消息并发投递到多个消费者时仍可能重复处理, 业务需要严格幂等时应在处理中加锁
+func Idempotent(store dedupe.Store, h ConsumerHandle) ConsumerHandle {
+	return func(ctx context.Context, msg Message) error {
+		id := msg.MessageID()
+		if len(id) == 0 {
+			return h(ctx, msg)
+		}
+		seen, err := store.Seen(ctx, id)
+		if err != nil {
+			return err
+		}
+		if seen {
+			log.Debugf("rabbitmq %s skip duplicate message %s", msg.Key(), id)
+			return nil
+		}
+		if err = h(ctx, msg); err != nil {
+			return err
+		}
+		return store.Mark(ctx, id)
+	}
+}
@@ -0,0 +1,191 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/rabbitmq/amqp091-go"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 延时交换机插件的延时消息头, 单位毫秒
+	headerDelay = "x-delay"
+	// 延时队列空闲超过延时加该时间后自动删除
+	delayQueueIdle = 10 * time.Minute
+	// 距上次声明超过该时间后重新声明, 保证队列中最后一条消息过期前不会被删除
+	delayRedeclare = 5 * time.Minute
+)
+
+// defaultDelayBuckets TTL 队列默认的延时档位
+var defaultDelayBuckets = []time.Duration{
+	time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+	time.Minute, 5 * time.Minute, 10 * time.Minute, 30 * time.Minute,
+	time.Hour, 2 * time.Hour, 6 * time.Hour, 12 * time.Hour, 24 * time.Hour,
+}
+
+// DelayMode 延时消息的投递方式
+type DelayMode int
+
+const (
+	// DelayAuto 安装了延时插件且交换机名称包含 delayed 时使用插件, 否则使用 TTL 队列
+	DelayAuto DelayMode = iota
+	// DelayPlugin 总是使用 x-delay, 交换机需为 x-delayed-message 类型
+	DelayPlugin
+	// DelayTTL 总是使用 TTL 队列, 消息过期后转入目标交换机
+	// 延时向上取整到 Producer.DelayBuckets 的档位, 如 1.5s 取整为 5s, 31m 取整为 1h
+	// 需要准确的延时时设置 Producer.DelayExact, 每个延时使用一个队列
+	DelayTTL
+)
+
+// delayQueue TTL 降级时每个目标以及延时对应一个队列
+func delayQueue(exchange, routingKey string, delay int64) string {
+	if len(exchange) == 0 {
+		exchange = "default"
+	}
+	return fmt.Sprintf("delay.%s.%s.%d", exchange, routingKey, delay)
+}
+
+// bucketDelay 延时向上取整到档位, 超过最大档位时取整到最大档位的倍数, 限制 TTL 队列的数量
+func bucketDelay(delay int64, buckets []time.Duration) int64 {
+	if len(buckets) == 0 {
+		buckets = defaultDelayBuckets
+	}
+	for _, b := range buckets {
+		if ms := b.Milliseconds(); delay <= ms {
+			return ms
+		}
+	}
+	max := buckets[len(buckets)-1].Milliseconds()
+	if max <= 0 {
+		return delay
+	}
+	return (delay + max - 1) / max * max
+}
+
+// delayMillis 消息头中的延时, 经过 JSON 的旧消息中为 float64
+func delayMillis(headers amqp091.Table) (int64, bool) {
+	switch v := headers[headerDelay].(type) {
+	case int64:
+		return v, true
+	case int32:
+		return int64(v), true
+	case int:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	case float32:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// delayQueues 已声明的延时队列以及声明时间, 每个连接一份
+type delayQueues struct {
+	sync.Mutex
+
+	declared map[string]time.Time
+}
+
+func newDelayQueues() *delayQueues {
+	return &delayQueues{declared: make(map[string]time.Time)}
+}
+
+// declare 声明延时队列, 近期声明过的队列跳过
+func (d *delayQueues) declare(channel *amqp091.Channel, exchange, routingKey string, delay int64) (string, error) {
+	queue := delayQueue(exchange, routingKey, delay)
+	d.Lock()
+	at, ok := d.declared[queue]
+	d.Unlock()
+	if ok && time.Since(at) < delayRedeclare {
+		return queue, nil
+	}
+
+	now := time.Now()
+	_, err := channel.QueueDeclare(queue, true, false, false, false, amqp091.Table{
+		amqp091.QueueMessageTTLArg:  delay,
+		amqp091.QueueTTLArg:         delay + delayQueueIdle.Milliseconds(),
+		"x-dead-letter-exchange":    exchange,
+		"x-dead-letter-routing-key": routingKey,
+	})
+	if err != nil {
+		return "", err
+	}
+	d.Lock()
+	d.declared[queue] = now
+	d.Unlock()
+	return queue, nil
+}
+
+// probeDelayedPlugin 声明临时的延时交换机判断是否安装了延时插件
+// 未安装时 broker 会关闭整个连接, 因此使用单独的连接
+// 只有 broker 明确返回不支持该交换机类型时才认为未安装, 其他错误(如没有权限)按已安装处理
+func probeDelayedPlugin(source string) bool {
+	conn, err := amqp091.Dial(source)
+	if err != nil {
+		return true
+	}
+	defer conn.Close()
+	channel, err := conn.Channel()
+	if err != nil {
+		return true
+	}
+
+	name := "delayed.probe." + newID()
+	err = channel.ExchangeDeclare(name, "x-delayed-message", false, true, false, false, amqp091.Table{"x-delayed-type": "direct"})
+	var amqpErr *amqp091.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp091.CommandInvalid {
+		log.Warnf("rabbitmq delayed message plugin not installed, delayed messages use TTL queues")
+		return false
+	}
+	if err == nil {
+		_ = channel.ExchangeDelete(name, false, false)
+	}
+	return true
+}
+
+// routeDelayed 带 x-delay 的消息按 DelayMode 选择投递方式
+// 使用 TTL 队列时延时按 DelayBuckets 向上取整(DelayExact 时不取整), 返回推送的交换机以及路由键
+func (c *Producer) routeDelayed(pool *channelPool, channel *amqp091.Channel, exchange, routingKey string, publishing *amqp091.Publishing) (string, string, error) {
+	delay, ok := delayMillis(publishing.Headers)
+	if !ok {
+		return exchange, routingKey, nil
+	}
+
+	c.RLock()
+	plugin := c.delayPlugin
+	c.RUnlock()
+	switch c.DelayMode {
+	case DelayPlugin:
+		return exchange, routingKey, nil
+	case DelayAuto:
+		if plugin && strings.Contains(exchange, "delayed") {
+			return exchange, routingKey, nil
+		}
+	}
+
+	// 推送失败时会以原消息重试, 不修改原消息头
+	headers := amqp091.Table{}
+	for k, v := range publishing.Headers {
+		if k != headerDelay {
+			headers[k] = v
+		}
+	}
+	publishing.Headers = headers
+	if delay <= 0 {
+		return exchange, routingKey, nil
+	}
+	// 死信时 expiration 会被移除, 只保留队列的 TTL
+	publishing.Expiration = ""
+	// 空闲超过 x-expires 后自动删除, 推送不会刷新空闲时间, 因此定期重新声明
+	if !c.DelayExact {
+		delay = bucketDelay(delay, c.DelayBuckets)
+	}
+	queue, err := pool.delays.declare(channel, exchange, routingKey, delay)
+	if err != nil {
+		return "", "", err
+	}
+	return "", queue, nil
+}
@@ -0,0 +1,254 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tonyhal/hercules/utils"
+	"sync"
+)
+
+var (
+	ErrServerStopped    = errors.New("rabbitmq: server stopped")
+	ErrConsumerExists   = errors.New("rabbitmq: consumer already exists")
+	ErrConsumerNotFound = errors.New("rabbitmq: consumer not found")
+)
+
+// worker 一个通道上的消费协程
+type worker struct {
+	sync.Mutex
+
+	tag  string
+	stop chan struct{} // 关闭后取消订阅
+	once sync.Once
+	done chan struct{} // 处理中的消息完成后关闭
+}
+
+func newWorker(tag string) *worker {
+	return &worker{
+		tag:  tag,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+func (w *worker) halt() {
+	w.once.Do(func() { close(w.stop) })
+}
+
+func (w *worker) stopping() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *worker) setTag(tag string) {
+	w.Lock()
+	w.tag = tag
+	w.Unlock()
+}
+
+func (w *worker) getTag() string {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.tag
+}
+
+// consumerKey 消费者的连接以及队列, 不同连接上可以消费同名队列
+type consumerKey struct {
+	identity string
+	queue    string
+}
+
+func (c Consumer) key() consumerKey {
+	return consumerKey{identity: c.Identity, queue: c.Queue}
+}
+
+// consumerGroup 运行中的消费者以及它的通道
+type consumerGroup struct {
+	consumer Consumer
+	conn     *connection
+	workers  []*worker
+	paused   bool
+}
+
+// halt 停止所有通道, 返回停止的通道
+func (g *consumerGroup) halt() []*worker {
+	workers := g.workers
+	for _, w := range workers {
+		w.halt()
+	}
+	g.workers = nil
+	return workers
+}
+
+// ConsumerState List 返回的消费者状态
+type ConsumerState struct {
+	Identity string
+	Exchange string
+	Queue    string
+	Fork     int      // 期望的通道数
+	Running  int      // 运行中的通道数
+	Paused   bool     // 暂停时不占用通道
+	Tags     []string // 每个通道的消费者标识
+}
+
+// startConsumer 订阅并启动消费者, 调用方持有锁
+func (s *Server) startConsumer(consumer Consumer) error {
+	conn, ok := s.conn[utils.Md5(consumer.Identity)]
+	if !ok {
+		return fmt.Errorf("%v, RabbitMQ不存在该连接", consumer.Identity)
+	}
+	if _, ok = s.groups[consumer.key()]; ok {
+		return fmt.Errorf("%w: %s %s", ErrConsumerExists, consumer.Identity, consumer.Queue)
+	}
+	g := &consumerGroup{consumer: consumer, conn: conn}
+	if err := s.scale(g, consumer.Fork); err != nil {
+		g.halt()
+		return err
+	}
+	s.groups[consumer.key()] = g
+	return nil
+}
+
+// scale 增加或减少通道到 n 个, 减少的通道处理完已推送的消息后关闭, 调用方持有锁
+// 连接断开时最多等待 subscribeTimeout, Stop 时立即返回
+func (s *Server) scale(g *consumerGroup, n int) error {
+	for len(g.workers) < n {
+		ctx, cancel := context.WithTimeout(s.stopCtx, subscribeTimeout)
+		sub, err := s.subscribe(ctx, g.conn, g.consumer)
+		cancel()
+		if err != nil {
+			return err
+		}
+		w := newWorker(sub.tag)
+		g.workers = append(g.workers, w)
+		s.consumers.Add(1)
+		go s.consume(s.baseCtx, g.conn, g.consumer, w, sub)
+	}
+	for len(g.workers) > n {
+		last := len(g.workers) - 1
+		g.workers[last].halt()
+		g.workers = g.workers[:last]
+	}
+	return nil
+}
+
+func (s *Server) group(identity, queue string) (*consumerGroup, error) {
+	select {
+	case <-s.stopping:
+		return nil, ErrServerStopped
+	default:
+	}
+	g, ok := s.groups[consumerKey{identity: identity, queue: queue}]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s %s", ErrConsumerNotFound, identity, queue)
+	}
+	return g, nil
+}
+
+// RemoveConsumer 取消订阅并移除消费者, 在 ctx 结束前等待处理中的消息完成
+func (s *Server) RemoveConsumer(ctx context.Context, identity, queue string) error {
+	s.Lock()
+	g, err := s.group(identity, queue)
+	if err != nil {
+		s.Unlock()
+		return err
+	}
+	workers := g.halt()
+	delete(s.groups, g.consumer.key())
+	for i, consumer := range s.Consumers {
+		if consumer.key() == g.consumer.key() {
+			s.Consumers = append(s.Consumers[:i], s.Consumers[i+1:]...)
+			break
+		}
+	}
+	s.Unlock()
+
+	for _, w := range workers {
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// PauseConsumer 取消订阅但保留消费者, 处理中的消息在后台完成
+func (s *Server) PauseConsumer(identity, queue string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	g, err := s.group(identity, queue)
+	if err != nil {
+		return err
+	}
+	g.halt()
+	g.paused = true
+	return nil
+}
+
+// ResumeConsumer 按 Fork 重新订阅暂停的消费者
+func (s *Server) ResumeConsumer(identity, queue string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	g, err := s.group(identity, queue)
+	if err != nil {
+		return err
+	}
+	if !g.paused {
+		return nil
+	}
+	g.paused = false
+	return s.scale(g, g.consumer.Fork)
+}
+
+// ScaleConsumer 调整通道数, 暂停中的消费者在恢复时生效
+func (s *Server) ScaleConsumer(identity, queue string, fork int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	g, err := s.group(identity, queue)
+	if err != nil {
+		return err
+	}
+	g.consumer.Fork = fork
+	for i := range s.Consumers {
+		if s.Consumers[i].key() == g.consumer.key() {
+			s.Consumers[i].Fork = fork
+		}
+	}
+	if g.paused {
+		return nil
+	}
+	return s.scale(g, fork)
+}
+
+// List 运行中的消费者状态
+func (s *Server) List() []ConsumerState {
+	s.RLock()
+	defer s.RUnlock()
+
+	list := make([]ConsumerState, 0, len(s.groups))
+	for _, g := range s.groups {
+		state := ConsumerState{
+			Identity: g.consumer.Identity,
+			Exchange: g.consumer.Exchange,
+			Queue:    g.consumer.Queue,
+			Fork:     g.consumer.Fork,
+			Running:  len(g.workers),
+			Paused:   g.paused,
+		}
+		for _, w := range g.workers {
+			state.Tags = append(state.Tags, w.getTag())
+		}
+		list = append(list, state)
+	}
+	return list
+}
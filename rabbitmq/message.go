@@ -0,0 +1,109 @@
+package rabbitmq
+
+import (
+	"github.com/rabbitmq/amqp091-go"
+	"time"
+)
+
+// Message 消费的消息, 包括消息属性以及投递信息
+type Message struct {
+	key   string
+	value []byte
+
+	headers       amqp091.Table
+	contentType   string
+	messageID     string
+	correlationID string
+	replyTo       string
+	timestamp     time.Time
+	redelivered   bool
+	routingKey    string
+	exchange      string
+	deliveryTag   uint64
+}
+
+func newMessage(queue string, delivery amqp091.Delivery) Message {
+	return Message{
+		key:           queue,
+		value:         delivery.Body,
+		headers:       delivery.Headers,
+		contentType:   delivery.ContentType,
+		messageID:     delivery.MessageId,
+		correlationID: delivery.CorrelationId,
+		replyTo:       delivery.ReplyTo,
+		timestamp:     delivery.Timestamp,
+		redelivered:   delivery.Redelivered,
+		routingKey:    delivery.RoutingKey,
+		exchange:      delivery.Exchange,
+		deliveryTag:   delivery.DeliveryTag,
+	}
+}
+
+func (m *Message) Set(key string, val []byte) {
+	m.key = key
+	m.value = val
+}
+
+// Key 队列名称
+func (m *Message) Key() string {
+	return m.key
+}
+
+// Value 消息内容
+func (m *Message) Value() []byte {
+	return m.value
+}
+
+// Headers 消息头
+func (m *Message) Headers() amqp091.Table {
+	return m.headers
+}
+
+// Header 获取消息头, 不存在时返回 nil
+func (m *Message) Header(key string) interface{} {
+	return m.headers[key]
+}
+
+func (m *Message) ContentType() string {
+	return m.contentType
+}
+
+func (m *Message) MessageID() string {
+	return m.messageID
+}
+
+func (m *Message) CorrelationID() string {
+	return m.correlationID
+}
+
+func (m *Message) ReplyTo() string {
+	return m.replyTo
+}
+
+// Timestamp 推送时间
+func (m *Message) Timestamp() time.Time {
+	return m.timestamp
+}
+
+// Redelivered 是否为重新投递的消息
+func (m *Message) Redelivered() bool {
+	return m.redelivered
+}
+
+func (m *Message) RoutingKey() string {
+	return m.routingKey
+}
+
+func (m *Message) Exchange() string {
+	return m.exchange
+}
+
+// DeliveryTag 通道内的投递序号
+func (m *Message) DeliveryTag() uint64 {
+	return m.deliveryTag
+}
+
+// Attempt 第几次处理该消息, 从 1 开始, 按重试策略重新推送时递增
+func (m *Message) Attempt() int {
+	return retryAttempt(m.headers) + 1
+}
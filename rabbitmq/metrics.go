@@ -0,0 +1,155 @@
+package rabbitmq
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/url"
+	"sync"
+)
+
+var (
+	metricPublishSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "rabbitmq",
+		Subsystem: "producer",
+		Name:      "duration_sec",
+		Help:      "rabbitmq publish confirm duratio(sec).",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.250, 0.5, 1},
+	}, []string{"exchange"})
+
+	metricPublishTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rabbitmq",
+		Subsystem: "producer",
+		Name:      "messages_total",
+		Help:      "The total number of published messages",
+	}, []string{"exchange", "outcome"})
+
+	metricConsumeSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "rabbitmq",
+		Subsystem: "consumer",
+		Name:      "duration_sec",
+		Help:      "rabbitmq consumer handle duratio(sec).",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.250, 0.5, 1, 5},
+	}, []string{"exchange", "queue"})
+
+	metricConsumeTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rabbitmq",
+		Subsystem: "consumer",
+		Name:      "messages_total",
+		Help:      "The total number of consumed messages",
+	}, []string{"exchange", "queue", "outcome"})
+
+	metricRedeliveredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rabbitmq",
+		Subsystem: "consumer",
+		Name:      "redelivered_total",
+		Help:      "The total number of redelivered messages",
+	}, []string{"exchange", "queue"})
+
+	metricReconnectTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rabbitmq",
+		Subsystem: "connection",
+		Name:      "reconnects_total",
+		Help:      "The total number of reconnects",
+	}, []string{"role", "name"})
+
+	states = &stateCollector{
+		desc: prometheus.NewDesc("rabbitmq_connection_up", "Whether any rabbitmq connection with the role and name is connected.", []string{"role", "name"}, nil),
+		conn: make(map[stateSource]struct{}),
+	}
+)
+
+func init() {
+	prometheus.MustRegister(metricPublishSeconds, metricPublishTotal, metricConsumeSeconds, metricConsumeTotal,
+		metricRedeliveredTotal, metricReconnectTotal, states)
+}
+
+// 消费结果
+const (
+	outcomeAck        = "ack"
+	outcomeRequeue    = "requeue"
+	outcomeRetry      = "retry"
+	outcomeDeadLetter = "dead_letter"
+)
+
+// publishOutcome 推送结果
+func publishOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "ack"
+	case errors.Is(err, ErrNack):
+		return "nack"
+	case errors.Is(err, ErrConfirmTimeout):
+		return "timeout"
+	case errors.Is(err, ErrUnroutable):
+		return "unroutable"
+	default:
+		return "error"
+	}
+}
+
+// sourceName 去掉账号密码的连接地址
+func sourceName(source string) string {
+	u, err := url.Parse(source)
+	if err != nil {
+		return ""
+	}
+	return u.Host + u.Path
+}
+
+// stateSource 上报连接状态
+type stateSource interface {
+	connState() (role, name string, up bool)
+}
+
+// stateCollector 采集时上报所有连接的状态
+type stateCollector struct {
+	sync.Mutex
+
+	desc *prometheus.Desc
+	conn map[stateSource]struct{}
+}
+
+func (c *stateCollector) add(s stateSource) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.conn[s] = struct{}{}
+}
+
+func (c *stateCollector) remove(s stateSource) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.conn, s)
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect 复制连接列表后再读取状态, 不在持有锁时调用 connState
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	sources := make([]stateSource, 0, len(c.conn))
+	for s := range c.conn {
+		sources = append(sources, s)
+	}
+	c.Unlock()
+
+	// 同一 broker 上的多个生产者或同名的连接只上报一次, 任一连接正常即为 1
+	type key struct{ role, name string }
+	values := make(map[key]float64, len(sources))
+	for _, s := range sources {
+		role, name, up := s.connState()
+		k := key{role, name}
+		if _, ok := values[k]; !ok {
+			values[k] = 0
+		}
+		if up {
+			values[k] = 1
+		}
+	}
+	for k, value := range values {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, value, k.role, k.name)
+	}
+}
@@ -0,0 +1,29 @@
+package rabbitmq
+
+import (
+	"context"
+	"github.com/go-kratos/kratos/v2/middleware"
+	"time"
+)
+
+// Timeout 限制单条消息的处理时间
+func Timeout(timeout time.Duration) middleware.Middleware {
+	return func(handler middleware.Handler) middleware.Handler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return handler(ctx, req)
+		}
+	}
+}
+
+// chain 以 kratos middleware 包装消费方法, 请求为 Message
+func chain(handle ConsumerHandle, ms ...middleware.Middleware) middleware.Handler {
+	h := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, handle(ctx, req.(Message))
+	}
+	if len(ms) == 0 {
+		return h
+	}
+	return middleware.Chain(ms...)(h)
+}
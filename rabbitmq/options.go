@@ -0,0 +1,105 @@
+package rabbitmq
+
+import (
+	"github.com/rabbitmq/amqp091-go"
+	"strconv"
+	"time"
+)
+
+// PublishOption 推送消息的属性
+type PublishOption func(*amqp091.Publishing)
+
+// WithHeader 设置消息头
+func WithHeader(key string, value interface{}) PublishOption {
+	return func(p *amqp091.Publishing) {
+		if p.Headers == nil {
+			p.Headers = amqp091.Table{}
+		}
+		p.Headers[key] = value
+	}
+}
+
+// WithHeaders 合并消息头
+func WithHeaders(headers amqp091.Table) PublishOption {
+	return func(p *amqp091.Publishing) {
+		if p.Headers == nil {
+			p.Headers = amqp091.Table{}
+		}
+		for k, v := range headers {
+			p.Headers[k] = v
+		}
+	}
+}
+
+// WithContentType 默认 text/plain
+func WithContentType(contentType string) PublishOption {
+	return func(p *amqp091.Publishing) {
+		p.ContentType = contentType
+	}
+}
+
+// WithMessageID 默认使用 sonyflake 生成的唯一ID
+func WithMessageID(id string) PublishOption {
+	return func(p *amqp091.Publishing) {
+		p.MessageId = id
+	}
+}
+
+func WithCorrelationID(id string) PublishOption {
+	return func(p *amqp091.Publishing) {
+		p.CorrelationId = id
+	}
+}
+
+func WithReplyTo(replyTo string) PublishOption {
+	return func(p *amqp091.Publishing) {
+		p.ReplyTo = replyTo
+	}
+}
+
+// WithPriority 消息优先级 0-9, 队列需要设置 Topology.MaxPriority
+func WithPriority(priority uint8) PublishOption {
+	return func(p *amqp091.Publishing) {
+		p.Priority = priority
+	}
+}
+
+// WithTTL 消息过期时间, 延时消息降级为 TTL 队列时忽略
+func WithTTL(ttl time.Duration) PublishOption {
+	return func(p *amqp091.Publishing) {
+		p.Expiration = strconv.FormatInt(ttl.Milliseconds(), 10)
+	}
+}
+
+// WithDelay 延时投递, 交换机为延时交换机且安装了 rabbitmq_delayed_message_exchange 插件时使用 x-delay
+// 否则经过 TTL 队列过期后转入目标交换机, 此时延时向上取整到 Producer.DelayBuckets 的档位
+// 消息可能明显晚于设置的延时到达(如 1.5s 取整为 5s), 需要准确延时时设置 Producer.DelayExact, 见 Producer.DelayMode
+func WithDelay(delay time.Duration) PublishOption {
+	return func(p *amqp091.Publishing) {
+		if p.Headers == nil {
+			p.Headers = amqp091.Table{}
+		}
+		p.Headers[headerDelay] = delay.Milliseconds()
+	}
+}
+
+// WithType 消息类型
+func WithType(typ string) PublishOption {
+	return func(p *amqp091.Publishing) {
+		p.Type = typ
+	}
+}
+
+// WithAppID 推送方应用标识
+func WithAppID(appID string) PublishOption {
+	return func(p *amqp091.Publishing) {
+		p.AppId = appID
+	}
+}
+
+// WithTransient 不持久化的消息, 默认持久化
+func WithTransient() PublishOption {
+	return func(p *amqp091.Publishing) {
+		p.DeliveryMode = amqp091.Transient
+	}
+}
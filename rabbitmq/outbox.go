@@ -0,0 +1,290 @@
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/go-kratos/kratos/v2/transport"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"sync"
+	"time"
+)
+
+var _ transport.Server = (*Outbox)(nil)
+
+// 发件箱消息状态
+const (
+	OutboxPending int8 = iota
+	OutboxSent
+	OutboxFailed // 超过最大重试次数, 不再推送
+)
+
+// OutboxMessage 发件箱消息, 与业务数据在同一事务中写入, 提交后由 Outbox 推送
+type OutboxMessage struct {
+	ID            uint64    `gorm:"primaryKey;autoIncrement"`
+	MessageID     string    `gorm:"size:64;not null;index"`
+	Exchange      string    `gorm:"size:255;not null"`
+	RoutingKey    string    `gorm:"size:255;not null"`
+	Properties    string    `gorm:"type:mediumtext"` // 消息属性, 不包括消息体, 消息头按类型编码, 最大 16MB
+	Body          []byte    `gorm:"type:longblob"`
+	Status        int8      `gorm:"not null;default:0;index:idx_outbox_status,priority:1"`
+	Attempts      int       `gorm:"not null;default:0"`
+	NextAttemptAt time.Time `gorm:"not null;index:idx_outbox_status,priority:2"`
+	LastError     string    `gorm:"size:1024"`
+	SentAt        *time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+func (OutboxMessage) TableName() string {
+	return "rabbitmq_outbox"
+}
+
+// Enqueue 在事务 tx 中写入待推送的消息, 事务回滚时消息一并丢弃
+func Enqueue(tx *gorm.DB, exchange, routingKey string, body []byte, opts ...PublishOption) error {
+	publishing := newPublishing(body)
+	for _, o := range opts {
+		o(&publishing)
+	}
+	publishing.Body = nil
+	properties, err := json.Marshal(newStoredPublishing(publishing))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return tx.Create(&OutboxMessage{
+		MessageID:     publishing.MessageId,
+		Exchange:      exchange,
+		RoutingKey:    routingKey,
+		Properties:    string(properties),
+		Body:          body,
+		Status:        OutboxPending,
+		NextAttemptAt: now,
+	}).Error
+}
+
+// Outbox 轮询发件箱并推送消息, 等待确认后标记为已发送, 失败按退避重试
+// 多个实例同时运行时通过 FOR UPDATE SKIP LOCKED 分配消息
+type Outbox struct {
+	db       *gorm.DB
+	producer *Producer
+
+	interval    time.Duration
+	batch       int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	maxAttempts int
+	timeout     time.Duration
+	migrate     bool
+
+	trigger chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+type OutboxOption func(*Outbox)
+
+// WithOutboxInterval 轮询间隔, 默认 1 秒
+func WithOutboxInterval(interval time.Duration) OutboxOption {
+	return func(o *Outbox) {
+		o.interval = interval
+	}
+}
+
+// WithOutboxBatch 每次推送的最大消息数, 默认 100
+func WithOutboxBatch(batch int) OutboxOption {
+	return func(o *Outbox) {
+		o.batch = batch
+	}
+}
+
+// WithOutboxBackoff 首次重试间隔以及最大间隔, 之后每次翻倍
+func WithOutboxBackoff(backoff, maxBackoff time.Duration) OutboxOption {
+	return func(o *Outbox) {
+		o.backoff = backoff
+		o.maxBackoff = maxBackoff
+	}
+}
+
+// WithOutboxMaxAttempts 最多推送次数, 超过后标记为失败, 0 表示一直重试
+func WithOutboxMaxAttempts(attempts int) OutboxOption {
+	return func(o *Outbox) {
+		o.maxAttempts = attempts
+	}
+}
+
+// WithOutboxTimeout 每批推送等待确认的时间, 超时的消息按失败重试, 默认 30 秒
+func WithOutboxTimeout(timeout time.Duration) OutboxOption {
+	return func(o *Outbox) {
+		o.timeout = timeout
+	}
+}
+
+// WithOutboxAutoMigrate 启动时创建发件箱表
+func WithOutboxAutoMigrate() OutboxOption {
+	return func(o *Outbox) {
+		o.migrate = true
+	}
+}
+
+func NewOutbox(db *gorm.DB, producer *Producer, opts ...OutboxOption) *Outbox {
+	o := &Outbox{
+		db:         db,
+		producer:   producer,
+		interval:   time.Second,
+		batch:      100,
+		backoff:    time.Second,
+		maxBackoff: 10 * time.Minute,
+		timeout:    30 * time.Second,
+		trigger:    make(chan struct{}, 1),
+	}
+	o.ctx, o.cancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func (o *Outbox) Name() string {
+	return "rabbitmq.outbox"
+}
+
+// Notify 事务提交后调用, 立即推送而不等待下次轮询
+func (o *Outbox) Notify() {
+	select {
+	case o.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (o *Outbox) Start(ctx context.Context) error {
+	if o.migrate {
+		if err := o.db.WithContext(ctx).AutoMigrate(&OutboxMessage{}); err != nil {
+			return err
+		}
+	}
+
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+
+		ticker := time.NewTicker(o.interval)
+		defer ticker.Stop()
+		for {
+			// 一批推送满时继续推送下一批
+			for {
+				n, err := o.relay(o.ctx)
+				if err != nil && o.ctx.Err() == nil {
+					log.Errorf("[%s] relay err %v", o.Name(), err)
+				}
+				if err != nil || n < o.batch {
+					break
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-o.trigger:
+			case <-o.ctx.Done():
+				return
+			}
+		}
+	}()
+	log.Infof("[%s] server starting.", o.Name())
+	return nil
+}
+
+func (o *Outbox) Stop(_ context.Context) error {
+	defer log.Infof("[%s] server stopping.", o.Name())
+
+	o.cancel()
+	o.wg.Wait()
+	return nil
+}
+
+// relay 锁定一批到期的消息并推送, 在同一事务中更新推送结果
+func (o *Outbox) relay(ctx context.Context) (int, error) {
+	var count int
+	err := o.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var messages []OutboxMessage
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", OutboxPending, time.Now()).
+			Order("id").
+			Limit(o.batch).
+			Find(&messages).Error
+		if err != nil || len(messages) == 0 {
+			return err
+		}
+		count = len(messages)
+
+		// 先全部推送, 再逐条等待确认, 整批限时避免 broker 不可用时长时间持有行锁
+		wctx, cancel := context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+		futures := make([]*PublishFuture, len(messages))
+		for i, m := range messages {
+			futures[i] = o.publish(wctx, m)
+		}
+		for i, m := range messages {
+			if err := o.update(tx, m, futures[i].Wait(wctx)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// publish 不经过断线缓存, 未收到 broker 确认的消息不会标记为已发送
+func (o *Outbox) publish(ctx context.Context, m OutboxMessage) *PublishFuture {
+	var stored storedPublishing
+	if len(m.Properties) > 0 {
+		if err := json.Unmarshal([]byte(m.Properties), &stored); err != nil {
+			return failedPublishFuture(err)
+		}
+	}
+	publishing := stored.publishing()
+	publishing.Body = m.Body
+	return o.producer.tracedPublish(ctx, m.Exchange, m.RoutingKey, publishing, false)
+}
+
+// update 记录推送结果, 失败时按退避计算下次推送时间
+func (o *Outbox) update(tx *gorm.DB, m OutboxMessage, err error) error {
+	now := time.Now()
+	if err == nil {
+		return tx.Model(&m).Updates(map[string]interface{}{
+			"status":   OutboxSent,
+			"attempts": m.Attempts + 1,
+			"sent_at":  now,
+		}).Error
+	}
+
+	attempts := m.Attempts + 1
+	status := OutboxPending
+	if o.maxAttempts > 0 && attempts >= o.maxAttempts {
+		status = OutboxFailed
+		log.Errorf("[%s] message %s failed after %d attempts: %v", o.Name(), m.MessageID, attempts, err)
+	}
+	lastError := err.Error()
+	if len(lastError) > 1024 {
+		lastError = lastError[:1024]
+	}
+	return tx.Model(&m).Updates(map[string]interface{}{
+		"status":          status,
+		"attempts":        attempts,
+		"next_attempt_at": now.Add(o.retryAfter(attempts)),
+		"last_error":      lastError,
+	}).Error
+}
+
+func (o *Outbox) retryAfter(attempts int) time.Duration {
+	d := o.backoff
+	for i := 1; i < attempts && d < o.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > o.maxBackoff {
+		d = o.maxBackoff
+	}
+	return d
+}
@@ -0,0 +1,110 @@
+package rabbitmq
+
+import (
+	"context"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// pooledChannel 通道以及它的确认跟踪
+type pooledChannel struct {
+	*amqp091.Channel
+	confirms *confirmer
+}
+
+// channelPool confirm 模式的通道池, 最多打开 size 个通道, 由并发推送共享
+type channelPool struct {
+	conn     *amqp091.Connection
+	idle     chan *pooledChannel
+	slots    chan struct{}
+	onReturn func(amqp091.Return)
+	delays   *delayQueues
+}
+
+func newChannelPool(conn *amqp091.Connection, size int, onReturn func(amqp091.Return)) *channelPool {
+	return &channelPool{
+		conn:     conn,
+		idle:     make(chan *pooledChannel, size),
+		slots:    make(chan struct{}, size),
+		onReturn: onReturn,
+		delays:   newDelayQueues(),
+	}
+}
+
+// Get 获取空闲通道, 没有空闲且未达上限时新建, 否则等待归还
+// 获取后到归还前由调用方独占, 保证 delivery tag 与推送对应
+func (p *channelPool) Get(ctx context.Context) (*pooledChannel, error) {
+	for {
+		// 优先使用空闲通道
+		select {
+		case ch := <-p.idle:
+			if ch.IsClosed() {
+				<-p.slots
+				continue
+			}
+			return ch, nil
+		default:
+		}
+
+		select {
+		case ch := <-p.idle:
+			if ch.IsClosed() {
+				<-p.slots
+				continue
+			}
+			return ch, nil
+		case p.slots <- struct{}{}:
+			ch, err := p.open()
+			if err != nil {
+				<-p.slots
+				return nil, err
+			}
+			return ch, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (p *channelPool) open() (*pooledChannel, error) {
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	// 确认消息
+	if err = ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	// 退回与确认在同一个协程中处理, broker 先发送 basic.return 再确认
+	c := newConfirmer(p.onReturn)
+	go c.loop(ch.NotifyPublish(make(chan amqp091.Confirmation, 128)), ch.NotifyReturn(make(chan amqp091.Return)))
+	return &pooledChannel{Channel: ch, confirms: c}, nil
+}
+
+// Put 归还通道, 已关闭的通道直接丢弃, 下次获取时重新创建
+func (p *channelPool) Put(ch *pooledChannel) {
+	if ch.IsClosed() {
+		<-p.slots
+		return
+	}
+	p.idle <- ch
+}
+
+// Discard 关闭并丢弃异常的通道
+func (p *channelPool) Discard(ch *pooledChannel) {
+	ch.Close()
+	<-p.slots
+}
+
+// Close 关闭所有空闲通道
+func (p *channelPool) Close() {
+	for {
+		select {
+		case ch := <-p.idle:
+			ch.Close()
+			<-p.slots
+		default:
+			return
+		}
+	}
+}
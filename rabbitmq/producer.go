@@ -1,96 +1,405 @@
 package rabbitmq
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/go-kratos/kratos/v2/log"
 	"github.com/rabbitmq/amqp091-go"
-
+	gosonyflake "github.com/sony/sonyflake"
+	"github.com/tonyhal/hercules/sonyflake"
 	"github.com/tonyhal/hercules/utils"
-	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	// 默认通道池大小
+	defaultPoolSize = 8
+	// Publish 默认超时时间
+	defaultPublishTimeout = 30 * time.Second
+)
+
+var ErrProducerClosed = errors.New("rabbitmq: producer closed")
+
+// ConnState 连接状态
+type ConnState int32
+
+const (
+	StateConnecting ConnState = iota
+	StateConnected
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
 type Producer struct {
 	sync.RWMutex
 
-	conn    *amqp091.Connection
-	channel *amqp091.Channel
-	Source  string
+	conn   *amqp091.Connection
+	pool   *channelPool
+	state  ConnState
+	ready  chan struct{} // 连接成功后关闭, 断开时重新创建
+	closed chan struct{}
+	once   sync.Once
+	buffer *offlineBuffer
+	// 是否安装了延时插件, 首次连接时探测一次
+	delayPlugin bool
+	probe       sync.Once
+
+	Source         string
+	PoolSize       int                  // confirm 通道池大小, 默认 8
+	ConfirmTimeout time.Duration        // 等待确认的时间, 默认 10 秒
+	PublishTimeout time.Duration        // Publish 的超时时间, 包括等待重连, 默认 30 秒
+	BufferSize     int                  // 断线期间缓存的消息数, 0 表示阻塞等待重连, 此时不使用 SpillDir
+	SpillDir       string               // 缓存满后写入磁盘的目录, 为空时阻塞等待重连; 启动时重放其中未完成的消息
+	Mandatory      bool                 // 无法路由到队列的消息被退回, 推送返回 ErrUnroutable; 按 MessageId 对应, 为空时无法对应
+	OnReturn       func(amqp091.Return) // 消息被退回时回调, 回调阻塞时通道也会阻塞
+	DelayMode      DelayMode            // WithDelay 的投递方式, 默认 DelayAuto
+	DelayBuckets   []time.Duration      // TTL 队列的延时档位, 延时向上取整, 默认 1s 到 24h 共 13 档
+	DelayExact     bool                 // TTL 队列不取整, 每个延时一个队列, 延时取值较多时队列数量随之增加
 }
 
+// Init 后台连接, 断线后自动重连
 func (c *Producer) Init() {
-	c.RLock()
-	defer c.RUnlock()
+	c.once.Do(func() {
+		c.Lock()
+		c.state = StateConnecting
+		c.ready = make(chan struct{})
+		c.closed = make(chan struct{})
+		c.buffer = newOfflineBuffer(c.BufferSize, c.SpillDir)
+		c.Unlock()
+
+		states.add(c)
+
+		go c.connectLoop()
+	})
+}
 
-	var err error
-	// 连接
-	if c.conn, err = amqp091.Dial(c.Source); err != nil {
-		time.AfterFunc(time.Second*3, func() { go c.Init() })
-		return
-	}
-	// 断线重连
-	go func(conn *amqp091.Connection) {
-		defer func() {
-			if err := recover(); err != nil {
-				log.Errorf("%s\n", string(debug.Stack()))
+func (c *Producer) connectLoop() {
+	for reconnect := false; ; reconnect = true {
+		conn, err := amqp091.Dial(c.Source)
+		if err != nil {
+			log.Errorf("failed opening connection to rabbitmq: %v", err)
+			select {
+			case <-time.After(time.Second * 3):
+				continue
+			case <-c.closed:
+				return
 			}
-		}()
+		}
+		if reconnect {
+			metricReconnectTotal.WithLabelValues("producer", sourceName(c.Source)).Inc()
+		}
+		notify := conn.NotifyClose(make(chan *amqp091.Error, 1))
+
+		// 通道池, 断线重连后重新创建
+		size := c.PoolSize
+		if size <= 0 {
+			size = defaultPoolSize
+		}
+		pool := newChannelPool(conn, size, c.OnReturn)
+		c.probe.Do(func() {
+			plugin := c.DelayMode == DelayAuto && probeDelayedPlugin(c.Source)
+			c.Lock()
+			c.delayPlugin = plugin
+			c.Unlock()
+		})
+		c.Lock()
+		c.conn, c.pool = conn, pool
+		c.Unlock()
+
+		// 重放断线期间缓存的消息, 完成后再切换为已连接
+		c.replay(pool)
 
-		var chanErr chan *amqp091.Error = conn.NotifyClose(make(chan *amqp091.Error))
 		select {
-		case _, ok := <-chanErr:
-			if !ok {
+		case err := <-notify:
+			log.Warnf("rabbitmq producer connection closed: %v, reconnecting", err)
+			c.Lock()
+			// 重放未完成时 ready 尚未关闭, 继续等待同一个 ready
+			if c.state == StateConnected {
+				c.ready = make(chan struct{})
 			}
+			c.state = StateConnecting
+			c.Unlock()
+			pool.Close()
+		case <-c.closed:
+			pool.Close()
 			conn.Close()
-			go c.Init()
+			return
 		}
-	}(c.conn)
+	}
 }
 
-// 推送消息
-func (c *Producer) Publish(body []byte, queue, exchange, expiration string) error {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Errorf("recover: %v", string(debug.Stack()))
+// replay 按批重放缓存的消息, 缓存为空时切换为已连接
+// 每批只处理开始时已缓存的消息, 失败的磁盘消息退避后重试, 连接断开时放回并等待重连
+func (c *Producer) replay(pool *channelPool) {
+	for pass := 0; ; pass++ {
+		c.Lock()
+		if c.state == StateClosed {
+			c.Unlock()
+			return
+		}
+		pending := c.buffer.Take()
+		if len(pending) == 0 {
+			c.state = StateConnected
+			close(c.ready)
+			c.Unlock()
+			return
 		}
-	}()
+		c.Unlock()
 
-	channel, err := c.conn.Channel()
-	if err != nil {
-		return err
+		retry, lost := c.replayPass(pool, pending)
+		c.buffer.Restore(retry)
+		if lost {
+			return
+		}
+		if len(retry) > 0 {
+			select {
+			case <-time.After(backoff(pass)):
+			case <-c.closed:
+				return
+			}
+		}
 	}
-	defer channel.Close()
+}
 
-	// 确认消息
-	if err := channel.Confirm(false); err != nil {
-		return err
+// replayPass 推送一批缓存的消息并等待确认, 返回需要重试的消息以及连接是否已断开
+// 内存中的消息把结果交给调用方, 磁盘中的消息失败多次后转存
+func (c *Producer) replayPass(pool *channelPool, pending []*pendingPublish) ([]*pendingPublish, bool) {
+	futures := make([]*PublishFuture, len(pending))
+	for i, p := range pending {
+		futures[i] = c.publishOn(context.Background(), pool, p.Exchange, p.RoutingKey, p.Publishing)
 	}
-	confirm := channel.NotifyPublish(make(chan amqp091.Confirmation, 1))
-	defer func(confirm <-chan amqp091.Confirmation) {
-		if confirmed := <-confirm; !confirmed.Ack {
-			log.Errorf("failed delivery of delivery tag: %v\n", confirmed.DeliveryTag)
+
+	var retry []*pendingPublish
+	lost := false
+	for i, p := range pending {
+		// 等待时间由确认超时限制
+		err := futures[i].Wait(context.Background())
+		if err == nil {
+			if p.future != nil {
+				p.future.complete(futures[i].DeliveryTag(), nil)
+			}
+			continue
+		}
+		// 连接断开导致的失败不计入次数
+		if errors.Is(err, amqp091.ErrClosed) || pool.conn.IsClosed() {
+			lost = true
+			retry = append(retry, p)
+			continue
+		}
+		p.Attempts++
+		switch {
+		case !p.spilled:
+			p.future.complete(0, err)
+		case p.Attempts >= maxReplayAttempts:
+			c.buffer.Park(p, err)
+		default:
+			log.Warnf("rabbitmq replay spilled message %s err %v, attempt %d", p.Publishing.MessageId, err, p.Attempts)
+			retry = append(retry, p)
 		}
-	}(confirm)
+	}
+	return retry, lost
+}
 
-	publishing := amqp091.Publishing{
+func (c *Producer) connState() (string, string, bool) {
+	return "producer", sourceName(c.Source), c.State() == StateConnected
+}
+
+// State 当前连接状态
+func (c *Producer) State() ConnState {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.state
+}
+
+// Close 关闭连接, 未重放的缓存消息返回 ErrProducerClosed, 磁盘中的消息保留到下次启动重放
+func (c *Producer) Close() error {
+	c.Lock()
+	if c.state == StateClosed {
+		c.Unlock()
+		return nil
+	}
+	c.state = StateClosed
+	// 未调用 Init
+	if c.closed != nil {
+		close(c.closed)
+		c.buffer.Close(ErrProducerClosed)
+	}
+	c.Unlock()
+
+	// 采集时会读取连接状态, 不能在持有锁时移除
+	states.remove(c)
+	return nil
+}
+
+// 推送消息, 等待 broker 确认, 被拒绝或超时时返回错误
+// 交换机名称包含 delayed 时 expiration 为延时毫秒数, 新代码使用 PublishWithContext 以及 WithDelay
+func (c *Producer) Publish(body []byte, queue, exchange, expiration string) error {
+	timeout := c.PublishTimeout
+	if timeout <= 0 {
+		timeout = defaultPublishTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var opts []PublishOption
+	if len(expiration) > 0 && strings.Contains(exchange, "delayed") {
+		if delay, err := strconv.ParseInt(expiration, 10, 64); err == nil {
+			opts = append(opts, WithDelay(time.Duration(delay)*time.Millisecond))
+		} else {
+			opts = append(opts, WithHeader(headerDelay, expiration))
+		}
+	}
+	return c.PublishWithContext(ctx, exchange, queue, body, opts...)
+}
+
+// PublishWithContext 推送消息并等待确认, ctx 控制等待重连以及确认的时间
+func (c *Producer) PublishWithContext(ctx context.Context, exchange, routingKey string, body []byte, opts ...PublishOption) error {
+	return c.PublishAsync(ctx, exchange, routingKey, body, opts...).Wait(ctx)
+}
+
+// PublishAsync 异步推送, 不等待确认即返回, 同一通道可连续推送多条消息
+func (c *Producer) PublishAsync(ctx context.Context, exchange, routingKey string, body []byte, opts ...PublishOption) *PublishFuture {
+	publishing := newPublishing(body)
+	for _, o := range opts {
+		o(&publishing)
+	}
+	return c.tracedPublish(ctx, exchange, routingKey, publishing, true)
+}
+
+// tracedPublish 创建推送 span 并写入消息头, 确认后结束 span 并记录指标
+// buffered 为 false 时断线期间不写入缓存, 等待重连
+func (c *Producer) tracedPublish(ctx context.Context, exchange, routingKey string, publishing amqp091.Publishing, buffered bool) *PublishFuture {
+	start := time.Now()
+	span := startProducerSpan(ctx, exchange, routingKey, &publishing)
+	future := c.publish(ctx, exchange, routingKey, publishing, buffered)
+	future.Then(func(err error) {
+		endSpan(span, err)
+		metricPublishSeconds.WithLabelValues(exchange).Observe(time.Since(start).Seconds())
+		metricPublishTotal.WithLabelValues(exchange, publishOutcome(err)).Inc()
+	})
+	return future
+}
+
+var (
+	idOnce  sync.Once
+	idFlake *gosonyflake.Sonyflake
+)
+
+// newID 唯一的消息ID, 相同内容的消息也不重复, sonyflake 不可用时使用随机数
+func newID() string {
+	idOnce.Do(func() { idFlake = sonyflake.NewSonyflake() })
+	if sf := idFlake; sf != nil {
+		if id, err := sf.NextID(); err == nil {
+			return strconv.FormatUint(id, 10)
+		}
+	}
+	return fmt.Sprintf("%d%d", time.Now().UnixNano(), utils.RandInt64())
+}
+
+func newPublishing(body []byte) amqp091.Publishing {
+	return amqp091.Publishing{
 		ContentType:  "text/plain", //application/json text/plain
 		Body:         body,
 		DeliveryMode: amqp091.Persistent, // 1=non-persistent, 2=persistent
-		MessageId:    utils.Md5(string(body)),
+		MessageId:    newID(),
 		Timestamp:    time.Now(),
 	}
-	if len(expiration) > 0 && strings.Contains(exchange, "delayed") {
-		publishing.Headers = amqp091.Table{"x-delay": expiration}
+}
+
+// publish 已连接时直接推送, 重连期间写入缓存或等待重连
+func (c *Producer) publish(ctx context.Context, exchange, routingKey string, publishing amqp091.Publishing, buffered bool) *PublishFuture {
+	for {
+		c.RLock()
+		state, pool, ready := c.state, c.pool, c.ready
+		c.RUnlock()
+
+		switch state {
+		case StateClosed:
+			return failedPublishFuture(ErrProducerClosed)
+		case StateConnected:
+			future := c.publishOn(ctx, pool, exchange, routingKey, publishing)
+			// 连接刚断开还未切换状态时, 稍后按重连处理
+			if !errors.Is(future.Err(), amqp091.ErrClosed) {
+				return future
+			}
+			select {
+			case <-time.After(100 * time.Millisecond):
+				continue
+			case <-ctx.Done():
+				return failedPublishFuture(ctx.Err())
+			}
+		}
+
+		c.Lock()
+		if buffered && c.state == StateConnecting && c.buffer != nil {
+			if future, ok := c.buffer.Put(exchange, routingKey, publishing); ok {
+				c.Unlock()
+				return future
+			}
+		}
+		c.Unlock()
+
+		// 不缓存或缓存已满, 等待重连
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return failedPublishFuture(ctx.Err())
+		}
 	}
-	if err := channel.Publish(
-		exchange, // publish to an exchange
-		queue,    // routing to 0 or more queues
-		false,    // mandatory
-		false,    // immediate
+}
+
+func (c *Producer) publishOn(ctx context.Context, pool *channelPool, exchange, routingKey string, publishing amqp091.Publishing) *PublishFuture {
+	channel, err := pool.Get(ctx)
+	if err != nil {
+		return failedPublishFuture(err)
+	}
+	// 延时消息可能改为推送到 TTL 队列
+	exchange, routingKey, err = c.routeDelayed(pool, channel.Channel, exchange, routingKey, &publishing)
+	if err != nil {
+		pool.Discard(channel)
+		return failedPublishFuture(err)
+	}
+
+	// 独占通道期间下一个序号即为该消息的 delivery tag, 推送前登记
+	tag := channel.GetNextPublishSeqNo()
+	timeout := c.ConfirmTimeout
+	if timeout <= 0 {
+		timeout = defaultConfirmTimeout
+	}
+	future := newPendingFuture()
+	channel.confirms.add(tag, publishing.MessageId, future, timeout)
+
+	err = channel.PublishWithContext(
+		ctx,
+		exchange,    // publish to an exchange
+		routingKey,  // routing to 0 or more queues
+		c.Mandatory, // mandatory
+		false,       // immediate
 		publishing,
-	); err != nil {
-		return err
+	)
+	if err != nil {
+		channel.confirms.remove(tag)
+		pool.Discard(channel)
+		future.complete(0, err)
+		return future
 	}
-	return nil
+	// 确认按 delivery tag 对应, 推送后即可归还通道供其他推送使用
+	pool.Put(channel)
+	return future
 }
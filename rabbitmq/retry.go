@@ -0,0 +1,183 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rabbitmq/amqp091-go"
+	"time"
+)
+
+const (
+	// 已重试次数
+	headerRetryAttempt = "x-retry-attempt"
+	// 最后一次处理失败的原因
+	headerRetryError = "x-retry-error"
+	// 未设置 MaxAttempts 时的最多处理次数
+	defaultMaxAttempts = 3
+)
+
+// RetryPolicy 处理失败后的重试策略, 超过次数后转入死信队列
+type RetryPolicy struct {
+	MaxAttempts int           // 最多处理次数, 包括首次, 默认 3; 为 1 时首次失败即转入死信队列
+	Backoff     time.Duration // 首次重试间隔, 之后每次翻倍, 默认 1 秒
+	MaxBackoff  time.Duration // 最大重试间隔, 默认 30 分钟
+	Delayed     bool          // 使用延时交换机插件, 否则每次重试使用带 TTL 的重试队列
+
+	DeadLetterExchange string // 默认 队列名.dlx
+	DeadLetterQueue    string // 默认 队列名.dlq
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return defaultMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d, limit := p.Backoff, p.MaxBackoff
+	if d <= 0 {
+		d = time.Second
+	}
+	if limit <= 0 {
+		limit = 30 * time.Minute
+	}
+	for i := 1; i < attempt && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	return d
+}
+
+func (p *RetryPolicy) deadLetter(queue string) (string, string) {
+	exchange, dlq := p.DeadLetterExchange, p.DeadLetterQueue
+	if len(exchange) == 0 {
+		exchange = queue + ".dlx"
+	}
+	if len(dlq) == 0 {
+		dlq = queue + ".dlq"
+	}
+	return exchange, dlq
+}
+
+// 延时交换机, 消息按 x-delay 延时后路由回原队列
+func retryExchange(queue string) string {
+	return queue + ".retry"
+}
+
+// 第 attempt 次重试的 TTL 队列, 消息过期后经默认交换机回到原队列
+func retryQueue(queue string, attempt int) string {
+	return fmt.Sprintf("%s.retry.%d", queue, attempt)
+}
+
+// undecodablePolicy 未配置重试时, 无法解码的消息转入 队列名.dlq
+var undecodablePolicy = &RetryPolicy{}
+
+// declareDeadLetter 声明死信交换机以及死信队列
+func (p *RetryPolicy) declareDeadLetter(channel *amqp091.Channel, queue string) error {
+	exchange, dlq := p.deadLetter(queue)
+	if err := channel.ExchangeDeclare(exchange, "direct", true, false, false, false, nil); err != nil {
+		return err
+	}
+	if _, err := channel.QueueDeclare(dlq, true, false, false, false, nil); err != nil {
+		return err
+	}
+	return channel.QueueBind(dlq, queue, exchange, false, nil)
+}
+
+// declare 声明重试、死信需要的交换机以及队列
+func (p *RetryPolicy) declare(channel *amqp091.Channel, queue string) error {
+	if err := p.declareDeadLetter(channel, queue); err != nil {
+		return err
+	}
+
+	if p.Delayed {
+		if err := channel.ExchangeDeclare(retryExchange(queue), "x-delayed-message", true, false, false, false, amqp091.Table{"x-delayed-type": "direct"}); err != nil {
+			return err
+		}
+		return channel.QueueBind(queue, queue, retryExchange(queue), false, nil)
+	}
+	for attempt := 1; attempt < p.maxAttempts(); attempt++ {
+		if _, err := channel.QueueDeclare(retryQueue(queue, attempt), true, false, false, false, amqp091.Table{
+			"x-message-ttl":             p.backoff(attempt).Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retry 重新推送失败的消息, 超过次数或无法解码时转入死信队列, 推送成功后确认原消息
+// 返回是否转入了死信队列
+func (p *RetryPolicy) retry(ctx context.Context, channel *amqp091.Channel, queue string, delivery amqp091.Delivery, cause error) (bool, error) {
+	attempt := retryAttempt(delivery.Headers) + 1
+
+	headers := amqp091.Table{}
+	for k, v := range delivery.Headers {
+		headers[k] = v
+	}
+	headers[headerRetryAttempt] = int64(attempt)
+	headers[headerRetryError] = cause.Error()
+	publishing := amqp091.Publishing{
+		Headers:         headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    delivery.DeliveryMode,
+		Priority:        delivery.Priority,
+		CorrelationId:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		MessageId:       delivery.MessageId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		UserId:          delivery.UserId,
+		AppId:           delivery.AppId,
+		Body:            delivery.Body,
+	}
+
+	var exchange, key string
+	// 无法解码的消息重试也不会成功
+	deadLetter := attempt >= p.maxAttempts() || errors.Is(cause, ErrUndecodable)
+	switch {
+	case deadLetter:
+		exchange, _ = p.deadLetter(queue)
+		key = queue
+	case p.Delayed:
+		exchange, key = retryExchange(queue), queue
+		headers["x-delay"] = p.backoff(attempt).Milliseconds()
+	default:
+		exchange, key = "", retryQueue(queue, attempt)
+	}
+
+	confirm, err := channel.PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, publishing)
+	if err != nil {
+		return deadLetter, err
+	}
+	if acked, err := confirm.WaitContext(ctx); err != nil {
+		return deadLetter, err
+	} else if !acked {
+		return deadLetter, fmt.Errorf("%w, delivery tag %d", ErrNack, confirm.DeliveryTag)
+	}
+	return deadLetter, delivery.Ack(false)
+}
+
+// retryAttempt 消息头中的已重试次数
+func retryAttempt(headers amqp091.Table) int {
+	switch v := headers[headerRetryAttempt].(type) {
+	case int:
+		return v
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	}
+	return 0
+}
@@ -0,0 +1,168 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/rabbitmq/amqp091-go"
+	"sync"
+	"time"
+)
+
+// ErrUnroutable mandatory 消息没有匹配的队列, 被 broker 退回
+var ErrUnroutable = errors.New("rabbitmq: message unroutable")
+
+// UnroutableError 被退回的消息, errors.Is(err, ErrUnroutable) 为 true
+type UnroutableError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *UnroutableError) Error() string {
+	return fmt.Sprintf("rabbitmq: message unroutable, exchange %q routing key %q: %d %s", e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+func (e *UnroutableError) Is(target error) bool {
+	return target == ErrUnroutable
+}
+
+// confirmEntry 等待确认的推送
+type confirmEntry struct {
+	messageID string
+	future    *PublishFuture
+	timer     *time.Timer
+	returned  *UnroutableError
+}
+
+// confirmer 按 delivery tag 跟踪一个通道上的推送
+// 退回与确认在同一个协程中处理, 退回的消息按 MessageId 对应推送, 在收到确认时以 ErrUnroutable 完成
+type confirmer struct {
+	sync.Mutex
+
+	pending  map[uint64]*confirmEntry
+	messages map[string][]uint64 // MessageId 对应的 delivery tag, 按推送顺序
+	onReturn func(amqp091.Return)
+}
+
+func newConfirmer(onReturn func(amqp091.Return)) *confirmer {
+	return &confirmer{
+		pending:  make(map[uint64]*confirmEntry),
+		messages: make(map[string][]uint64),
+		onReturn: onReturn,
+	}
+}
+
+// add 推送前登记, 超过 timeout 未确认时以 ErrConfirmTimeout 完成
+func (c *confirmer) add(tag uint64, messageID string, future *PublishFuture, timeout time.Duration) {
+	entry := &confirmEntry{messageID: messageID, future: future}
+	entry.timer = time.AfterFunc(timeout, func() {
+		c.remove(tag)
+		future.complete(tag, fmt.Errorf("%w, delivery tag %d", ErrConfirmTimeout, tag))
+	})
+	c.Lock()
+	c.pending[tag] = entry
+	if len(messageID) > 0 {
+		c.messages[messageID] = append(c.messages[messageID], tag)
+	}
+	c.Unlock()
+}
+
+func (c *confirmer) remove(tag uint64) *confirmEntry {
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.pending[tag]
+	if !ok {
+		return nil
+	}
+	delete(c.pending, tag)
+	entry.timer.Stop()
+	if tags := c.messages[entry.messageID]; len(tags) > 0 {
+		for i, t := range tags {
+			if t == tag {
+				tags = append(tags[:i], tags[i+1:]...)
+				break
+			}
+		}
+		if len(tags) == 0 {
+			delete(c.messages, entry.messageID)
+		} else {
+			c.messages[entry.messageID] = tags
+		}
+	}
+	return entry
+}
+
+func (c *confirmer) loop(confirms <-chan amqp091.Confirmation, returns <-chan amqp091.Return) {
+	for {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			c.returned(ret)
+		case confirm, ok := <-confirms:
+			if !ok {
+				c.closed()
+				return
+			}
+			entry := c.remove(confirm.DeliveryTag)
+			if entry == nil {
+				continue
+			}
+			switch {
+			case !confirm.Ack:
+				entry.future.complete(confirm.DeliveryTag, fmt.Errorf("%w, delivery tag %d", ErrNack, confirm.DeliveryTag))
+			case entry.returned != nil:
+				entry.future.complete(confirm.DeliveryTag, entry.returned)
+			default:
+				entry.future.complete(confirm.DeliveryTag, nil)
+			}
+		}
+	}
+}
+
+func (c *confirmer) returned(ret amqp091.Return) {
+	if c.onReturn != nil {
+		c.onReturn(ret)
+	}
+	// 同一 MessageId 的推送按顺序退回, 对应最早的未退回推送
+	c.Lock()
+	var entry *confirmEntry
+	for _, tag := range c.messages[ret.MessageId] {
+		if e := c.pending[tag]; e != nil && e.returned == nil {
+			entry = e
+			break
+		}
+	}
+	if entry != nil {
+		entry.returned = &UnroutableError{
+			Exchange:   ret.Exchange,
+			RoutingKey: ret.RoutingKey,
+			ReplyCode:  ret.ReplyCode,
+			ReplyText:  ret.ReplyText,
+		}
+	}
+	c.Unlock()
+
+	if entry == nil && c.onReturn == nil {
+		log.Warnf("rabbitmq message %s returned, exchange %s routing key %s: %s", ret.MessageId, ret.Exchange, ret.RoutingKey, ret.ReplyText)
+	}
+}
+
+// closed 通道关闭时未确认的推送同样视为拒绝
+func (c *confirmer) closed() {
+	c.Lock()
+	pending := c.pending
+	c.pending = make(map[uint64]*confirmEntry)
+	c.messages = make(map[string][]uint64)
+	c.Unlock()
+
+	for tag, entry := range pending {
+		entry.timer.Stop()
+		entry.future.complete(tag, fmt.Errorf("%w, delivery tag %d: channel closed", ErrNack, tag))
+	}
+}
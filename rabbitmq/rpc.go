@@ -0,0 +1,258 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/rabbitmq/amqp091-go"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 直接回复队列, 无需声明
+	directReplyTo = "amq.rabbitmq.reply-to"
+	// 服务端处理失败的原因
+	headerRPCError = "x-rpc-error"
+	// Call 默认超时时间
+	defaultCallTimeout = 30 * time.Second
+)
+
+// ErrRPCClosed 等待回复时通道关闭
+var ErrRPCClosed = errors.New("rabbitmq: rpc channel closed")
+
+// RPCError 服务端处理失败
+type RPCError struct {
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rabbitmq: rpc error: %s", e.Message)
+}
+
+// RPCClient 请求/回复调用, 默认使用 direct reply-to, 按 correlation id 对应回复
+type RPCClient struct {
+	sync.Mutex
+
+	conn      *connection
+	cancel    context.CancelFunc
+	channel   *rpcChannel
+	timeout   time.Duration
+	exclusive bool
+}
+
+// rpcChannel 一个回复通道以及在它上面等待回复的调用, 通道重建后旧的调用单独结束
+type rpcChannel struct {
+	*amqp091.Channel
+
+	replyTo string
+	pending map[string]chan amqp091.Delivery
+	closed  bool
+}
+
+type RPCOption func(*RPCClient)
+
+// WithExclusiveReplyQueue 使用独占的回复队列代替 direct reply-to
+func WithExclusiveReplyQueue() RPCOption {
+	return func(c *RPCClient) {
+		c.exclusive = true
+	}
+}
+
+// WithCallTimeout ctx 未设置截止时间时的超时时间
+func WithCallTimeout(timeout time.Duration) RPCOption {
+	return func(c *RPCClient) {
+		c.timeout = timeout
+	}
+}
+
+func NewRPCClient(source string, opts ...RPCOption) (*RPCClient, error) {
+	c := &RPCClient{
+		conn:    newConnection(sourceName(source), source),
+		timeout: defaultCallTimeout,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	if err := c.conn.dial(); err != nil {
+		return nil, err
+	}
+	var ctx context.Context
+	ctx, c.cancel = context.WithCancel(context.Background())
+	go c.conn.watch(ctx)
+	return c, nil
+}
+
+// Call 推送请求并等待回复
+func (c *RPCClient) Call(ctx context.Context, exchange, routingKey string, body []byte, opts ...PublishOption) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	channel, err := c.setup(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	id := newID()
+	reply := make(chan amqp091.Delivery, 1)
+	c.Lock()
+	if channel.closed {
+		c.Unlock()
+		return nil, ErrRPCClosed
+	}
+	channel.pending[id] = reply
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		delete(channel.pending, id)
+		c.Unlock()
+	}()
+
+	publishing := newPublishing(body)
+	for _, o := range opts {
+		o(&publishing)
+	}
+	publishing.DeliveryMode = amqp091.Transient
+	publishing.CorrelationId = id
+	publishing.ReplyTo = channel.replyTo
+	if deadline, ok := ctx.Deadline(); ok {
+		// 超时后的请求不再需要处理
+		if ttl := time.Until(deadline).Milliseconds(); ttl > 0 {
+			publishing.Expiration = strconv.FormatInt(ttl, 10)
+		}
+	}
+	span := startProducerSpan(ctx, exchange, routingKey, &publishing)
+	if err = channel.PublishWithContext(ctx, exchange, routingKey, false, false, publishing); err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	select {
+	case delivery, ok := <-reply:
+		if !ok {
+			endSpan(span, ErrRPCClosed)
+			return nil, ErrRPCClosed
+		}
+		if msg, ok := delivery.Headers[headerRPCError].(string); ok {
+			err = &RPCError{Message: msg}
+		}
+		endSpan(span, err)
+		return delivery.Body, err
+	case <-ctx.Done():
+		endSpan(span, ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+// setup 打开通道并开始消费回复, 通道关闭后下次调用时重新创建
+func (c *RPCClient) setup(ctx context.Context) (*rpcChannel, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.channel != nil && !c.channel.closed && !c.channel.IsClosed() {
+		return c.channel, nil
+	}
+	channel, err := c.conn.Channel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replyTo := directReplyTo
+	if c.exclusive {
+		queue, err := channel.QueueDeclare("", false, true, true, false, nil)
+		if err != nil {
+			channel.Close()
+			return nil, err
+		}
+		replyTo = queue.Name
+	}
+	// direct reply-to 必须 auto ack, 且与推送使用同一通道
+	deliveries, err := channel.Consume(replyTo, "", true, c.exclusive, false, false, nil)
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+	c.channel = &rpcChannel{
+		Channel: channel,
+		replyTo: replyTo,
+		pending: make(map[string]chan amqp091.Delivery),
+	}
+	go c.dispatch(c.channel, deliveries)
+	return c.channel, nil
+}
+
+// dispatch 按 correlation id 分发回复, 通道关闭时只结束该通道上的等待
+func (c *RPCClient) dispatch(channel *rpcChannel, deliveries <-chan amqp091.Delivery) {
+	for delivery := range deliveries {
+		c.Lock()
+		reply, ok := channel.pending[delivery.CorrelationId]
+		c.Unlock()
+		if !ok {
+			log.Warnf("rabbitmq rpc reply %s without pending call", delivery.CorrelationId)
+			continue
+		}
+		// 重复的回复直接丢弃, 不阻塞后续回复的分发
+		select {
+		case reply <- delivery:
+		default:
+			log.Warnf("rabbitmq rpc duplicate reply %s", delivery.CorrelationId)
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	channel.closed = true
+	for id, reply := range channel.pending {
+		close(reply)
+		delete(channel.pending, id)
+	}
+}
+
+func (c *RPCClient) Close() error {
+	c.cancel()
+	return nil
+}
+
+// ReplyHandle 返回回复内容的消费方法
+type ReplyHandle func(context.Context, Message) ([]byte, error)
+
+type replierKey struct{}
+
+// replier 在消费通道上推送回复
+type replier func(ctx context.Context, replyTo string, publishing amqp091.Publishing) error
+
+func newReplyContext(ctx context.Context, channel *amqp091.Channel) context.Context {
+	return context.WithValue(ctx, replierKey{}, replier(func(ctx context.Context, replyTo string, publishing amqp091.Publishing) error {
+		return channel.PublishWithContext(ctx, "", replyTo, false, false, publishing)
+	}))
+}
+
+// Reply 将 ReplyHandle 包装为 ConsumerHandle, 处理结果自动推送到请求的 reply-to
+// 处理失败时回复错误并确认请求, 不再重试
+func Reply(h ReplyHandle) ConsumerHandle {
+	return func(ctx context.Context, msg Message) error {
+		body, err := h(ctx, msg)
+		if len(msg.ReplyTo()) == 0 {
+			return err
+		}
+		send, ok := ctx.Value(replierKey{}).(replier)
+		if !ok {
+			return fmt.Errorf("rabbitmq: reply %s outside of consumer", msg.ReplyTo())
+		}
+
+		publishing := amqp091.Publishing{
+			ContentType:   msg.ContentType(),
+			CorrelationId: msg.CorrelationID(),
+			Timestamp:     time.Now(),
+			Body:          body,
+		}
+		if err != nil {
+			publishing.Headers = amqp091.Table{headerRPCError: err.Error()}
+		}
+		return send(ctx, msg.ReplyTo(), publishing)
+	}
+}
@@ -2,47 +2,49 @@ package rabbitmq
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/go-kratos/kratos/v2/log"
+	"github.com/go-kratos/kratos/v2/middleware"
 	"github.com/go-kratos/kratos/v2/transport"
 	"github.com/rabbitmq/amqp091-go"
 	"github.com/tonyhal/hercules/utils"
-	"strings"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
 	_ transport.Server = (*Server)(nil)
 )
 
-type Message struct {
-	key   string
-	value []byte
-}
-
-func (m *Message) Set(key string, val []byte) {
-	m.key = key
-	m.value = val
-}
+// ErrHandlerPanic 消费方法 panic, 按处理失败重试或重新入队
+var ErrHandlerPanic = errors.New("rabbitmq: handler panic")
 
-func (m *Message) Key() string {
-	return m.key
-}
-
-func (m *Message) Value() []byte {
-	return m.value
-}
+// 持有锁订阅时等待连接的时间, 超时后返回错误, 避免阻塞 Stop 以及 List
+const subscribeTimeout = 10 * time.Second
 
 type Server struct {
 	sync.RWMutex
 
-	conn    map[string]*amqp091.Connection
-	channel map[string]*amqp091.Channel
+	conn map[string]*connection
 
-	baseCtx context.Context
-	cancel  context.CancelFunc
-	source  map[string]string
-	err     error
+	baseCtx   context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup // 重连协程
+	consumers sync.WaitGroup // 消费协程
+	stopping  chan struct{}
+	stopOnce  sync.Once
+	stopCtx   context.Context // Stop 时取消, 结束持有锁的订阅
+	stopAll   context.CancelFunc
+	tags      uint64
+	groups    map[consumerKey]*consumerGroup // 运行中的消费者, 按连接以及队列名
+	started   bool
+	source    map[string]string
+	err       error
+
+	middleware []middleware.Middleware
 
 	Consumers []Consumer
 }
@@ -56,12 +58,21 @@ func WithSource(source map[string]string) ServerOption {
 	}
 }
 
+// WithMiddleware 所有消费者共用的中间件, 在消费者自身的中间件之前执行
+func WithMiddleware(m ...middleware.Middleware) ServerOption {
+	return func(s *Server) {
+		s.middleware = m
+	}
+}
+
 func NewServer(opts ...ServerOption) *Server {
 	srv := &Server{
-		baseCtx: context.Background(),
-		conn:    make(map[string]*amqp091.Connection),
-		channel: make(map[string]*amqp091.Channel),
+		baseCtx:  context.Background(),
+		conn:     make(map[string]*connection),
+		stopping: make(chan struct{}),
+		groups:   make(map[consumerKey]*consumerGroup),
 	}
+	srv.stopCtx, srv.stopAll = context.WithCancel(context.Background())
 	srv.init(opts...)
 	return srv
 }
@@ -77,15 +88,14 @@ func (s *Server) Name() string {
 }
 
 func (s *Server) Connect() error {
-	s.RLock()
-	defer s.RUnlock()
-
 	for identity, source := range s.source {
-		s.conn[utils.Md5(identity)], s.err = amqp091.Dial(source)
-		if s.err != nil {
+		conn := newConnection(identity, source)
+		if s.err = conn.dial(); s.err != nil {
 			log.Errorf("failed opening connection to rabbitmq: %v\n", s.err)
 			return s.err
 		}
+		s.conn[utils.Md5(identity)] = conn
+		states.add(conn)
 	}
 
 	log.Infof("[%s] server starting.", s.Name())
@@ -93,8 +103,8 @@ func (s *Server) Connect() error {
 }
 
 func (s *Server) Start(ctx context.Context) error {
-	s.RLock()
-	defer s.RUnlock()
+	s.Lock()
+	defer s.Unlock()
 
 	s.err = s.Connect()
 	if s.err != nil {
@@ -103,87 +113,328 @@ func (s *Server) Start(ctx context.Context) error {
 	}
 
 	s.baseCtx, s.cancel = context.WithCancel(context.Background())
+	// 断线重连
+	for _, conn := range s.conn {
+		s.wg.Add(1)
+		go func(conn *connection) {
+			defer s.wg.Done()
+			conn.watch(s.baseCtx)
+		}(conn)
+	}
+
 	for _, consumer := range s.Consumers {
+		// 首次订阅失败时停止已订阅的消费者并返回, 之后断线由协程自动恢复
+		if err := s.startConsumer(consumer); err != nil {
+			for key, g := range s.groups {
+				g.halt()
+				delete(s.groups, key)
+			}
+			s.err = err
+			return err
+		}
+	}
+	s.started = true
+	return nil
+}
 
-		identity := utils.Md5(consumer.Identity)
+// subscription 一个通道上的订阅
+type subscription struct {
+	channel    *amqp091.Channel
+	deliveries <-chan amqp091.Delivery
+	tag        string
+	recv       sync.Mutex     // 并发读取时保证 offset 按接收顺序登记
+	offsets    *streamOffsets // stream 队列已处理的 offset
 
-		// 声明交换机延时、以及延时交换机
-		argv := amqp091.Table{}
-		exchangeSplit := strings.Split(strings.Trim(consumer.Exchange, ""), ".")
-		exchangeType := strings.ToLower(exchangeSplit[len(exchangeSplit)-1])
-		// 延时队列处理
-		if strings.Contains(consumer.Exchange, "delayed") {
-			exchangeType = "x-delayed-message"
-			argv["x-delayed-type"] = "direct"
+	deadLetter    sync.Once // 未配置重试时, 首次收到无法解码的消息再声明死信队列
+	deadLetterErr error
+}
+
+// declareDeadLetter 未配置重试的消费者在需要时开启确认并声明死信交换机以及死信队列
+func (sub *subscription) declareDeadLetter(queue string) error {
+	sub.deadLetter.Do(func() {
+		if sub.deadLetterErr = sub.channel.Confirm(false); sub.deadLetterErr != nil {
+			return
 		}
+		sub.deadLetterErr = undecodablePolicy.declareDeadLetter(sub.channel, queue)
+	})
+	return sub.deadLetterErr
+}
 
-		// 验证交换机类型
-		if !strings.Contains("|direct|fanout|headers|topic|x-delayed-message|", exchangeType) {
-			return fmt.Errorf("%v, RabbitMQ不存在该类型交换机", consumer.Exchange)
+// subscribe 打开通道, 声明交换机、队列并开始消费
+func (s *Server) subscribe(ctx context.Context, conn *connection, consumer Consumer) (*subscription, error) {
+	// 未声明拓扑时按命名推断
+	topology := consumer.Topology
+	if topology == nil {
+		var err error
+		if topology, err = conventionTopology(consumer); err != nil {
+			return nil, err
 		}
+	}
 
-		for i := 0; i < consumer.Fork; i++ {
-			// 获取通道
-			if s.channel[identity], s.err = s.conn[identity].Channel(); s.err != nil {
-				break
+	// 获取通道
+	channel, err := conn.Channel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// 声明交换机、队列并绑定
+	if err = topology.declare(channel, consumer.Exchange, consumer.Queue); err != nil {
+		channel.Close()
+		return nil, err
+	}
+	// 重试以及死信, 重新推送需要确认
+	if consumer.Retry != nil {
+		if err = channel.Confirm(false); err != nil {
+			channel.Close()
+			return nil, err
+		}
+		if err = consumer.Retry.declare(channel, consumer.Queue); err != nil {
+			channel.Close()
+			return nil, err
+		}
+	}
+	// 预取数量, 默认一个一个发送消息, 不少于并发数
+	prefetch := consumer.Prefetch
+	if prefetch < consumer.Concurrency {
+		prefetch = consumer.Concurrency
+	}
+	if prefetch <= 0 {
+		prefetch = 1
+	}
+	if err = channel.Qos(prefetch, 0, false); err != nil {
+		channel.Close()
+		return nil, err
+	}
+	// 指定消费者标识, 停止时取消订阅
+	tag := fmt.Sprintf("%s.%d", consumer.Queue, atomic.AddUint64(&s.tags, 1))
+	deliveries, err := channel.Consume(consumer.Queue, tag, false, false, false, false, consumer.Offset.args())
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+	return &subscription{channel: channel, deliveries: deliveries, tag: tag, offsets: newStreamOffsets()}, nil
+}
+
+// consume 处理消息, 通道或连接关闭后重新订阅, 停止时取消订阅并等待处理中的消息
+func (s *Server) consume(ctx context.Context, conn *connection, consumer Consumer, w *worker, sub *subscription) {
+	defer s.consumers.Done()
+	defer close(w.done)
+
+	ms := make([]middleware.Middleware, 0, len(s.middleware)+len(consumer.Middleware))
+	ms = append(append(ms, s.middleware...), consumer.Middleware...)
+	h := chain(consumer.Handle, ms...)
+	for {
+		done := make(chan struct{})
+		go func(sub *subscription) {
+			select {
+			case <-w.stop:
+				// 不再接收新消息, 已推送的消息由 handle 重新入队
+				if err := sub.channel.Cancel(sub.tag, false); err != nil {
+					log.Errorf("rabbitmq %s cancel consumer err %v", consumer.Queue, err)
+				}
+			case <-done:
 			}
-			// 声明交换机
-			s.channel[identity].ExchangeDeclare(consumer.Exchange, exchangeType, true, false, false, false, argv)
-			// 声明队列
-			s.channel[identity].QueueDeclare(consumer.Queue, true, false, false, false, amqp091.Table{"x-ha-policy": "all"})
-			// 绑定队列
-			s.err = s.channel[identity].QueueBind(consumer.Queue, consumer.Queue, consumer.Exchange, true, nil)
-			if s.err != nil {
+		}(sub)
+		s.handle(ctx, consumer, h, w, sub)
+		close(done)
+		sub.channel.Close()
+		if ctx.Err() != nil || w.stopping() {
+			log.Infof("rabbitmq %s closed.", consumer.Queue)
+			return
+		}
+		log.Warnf("rabbitmq %s channel closed, resubscribing", consumer.Queue)
+		// stream 队列从已处理的下一条继续, 避免重放
+		if offset := sub.offsets.last(); offset >= 0 {
+			consumer.Offset = OffsetAt(offset + 1)
+		}
+
+		// 按退避重新订阅, 连接断开时等待重连
+		for attempt := 0; ; attempt++ {
+			var err error
+			if sub, err = s.subscribe(ctx, conn, consumer); err == nil {
+				w.setTag(sub.tag)
+				log.Infof("rabbitmq %s resubscribed", consumer.Queue)
 				break
 			}
-			// 获取消费通道, 确保rabbitMQ一个一个发送消息
-			s.channel[identity].Qos(1, 0, true)
-			deliveries, err := s.channel[identity].Consume(consumer.Queue, "", false, false, false, false, nil)
-			if err != nil {
-				break
+			if ctx.Err() != nil {
+				return
+			}
+			log.Errorf("rabbitmq %s resubscribe err %v", consumer.Queue, err)
+			select {
+			case <-time.After(backoff(attempt)):
+			case <-w.stop:
+				return
+			case <-ctx.Done():
+				return
 			}
-			// 协程处理
-			go func(ctx context.Context, deliveries <-chan amqp091.Delivery, consumer Consumer) {
-				for {
-					select {
-					case <-ctx.Done():
-						log.Infof("rabbitmq %s closed.", consumer.Queue)
-						return
-					case delivery := <-deliveries:
-						// 循环读取消息
-						if err := consumer.Handle(context.Background(), Message{key: consumer.Queue, value: delivery.Body}); err != nil {
-							delivery.Nack(false, true)
-						} else {
-							delivery.Ack(false)
-						}
-					}
+		}
+	}
+}
+
+// handle 按并发数启动协程读取消息, 通道关闭或 ctx 结束时返回
+func (s *Server) handle(ctx context.Context, consumer Consumer, h middleware.Handler, w *worker, sub *subscription) {
+	concurrency := consumer.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				delivery, ok := s.receive(ctx, sub)
+				if !ok {
+					return
+				}
+				offset, stream := streamOffset(delivery.Headers)
+				// 停止中不再处理, 重新入队交给其他消费者
+				if w.stopping() {
+					delivery.Nack(false, true)
+					continue
+				}
+				if s.process(ctx, consumer, h, sub, delivery) && stream {
+					sub.offsets.done(offset)
 				}
-			}(s.baseCtx, deliveries, consumer)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// receive 读取下一条消息, stream 队列的 offset 在读取时登记, 通道关闭或 ctx 结束时返回 false
+func (s *Server) receive(ctx context.Context, sub *subscription) (amqp091.Delivery, bool) {
+	sub.recv.Lock()
+	defer sub.recv.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return amqp091.Delivery{}, false
+	case delivery, ok := <-sub.deliveries:
+		if ok {
+			if offset, stream := streamOffset(delivery.Headers); stream {
+				sub.offsets.receive(offset)
+			}
 		}
+		return delivery, ok
 	}
-	return s.err
 }
 
-func (s *Server) Stop(ctx context.Context) error {
-	s.cancel()
+// process 经过中间件处理单条消息并确认, context 中携带该消息的 Transport
+// 返回消息是否已处理完成, 即已确认或已转入重试、死信队列, 不需要重新投递
+func (s *Server) process(ctx context.Context, consumer Consumer, h middleware.Handler, sub *subscription, delivery amqp091.Delivery) bool {
+	channel := sub.channel
+	if delivery.Redelivered {
+		metricRedeliveredTotal.WithLabelValues(consumer.Exchange, consumer.Queue).Inc()
+	}
 
-	// 关闭通道
-	for _, channel := range s.channel {
-		channel.Close()
+	start := time.Now()
+	tr := newTransport(delivery.Exchange, consumer.Queue, delivery.Headers)
+	hctx, span := startConsumerSpan(newReplyContext(transport.NewServerContext(ctx, tr), channel), consumer.Queue, delivery)
+	err := s.invoke(hctx, consumer, h, delivery)
+	endSpan(span, err)
+	metricConsumeSeconds.WithLabelValues(consumer.Exchange, consumer.Queue).Observe(time.Since(start).Seconds())
+
+	outcome := outcomeAck
+	switch {
+	case err == nil:
+		delivery.Ack(false)
+	case consumer.Retry != nil || errors.Is(err, ErrUndecodable):
+		// 未配置重试时只有无法解码的消息转入死信队列
+		policy := consumer.Retry
+		var rerr error
+		if policy == nil {
+			policy = undecodablePolicy
+			rerr = sub.declareDeadLetter(consumer.Queue)
+		}
+		outcome = outcomeRetry
+		deadLetter := true
+		if rerr == nil {
+			deadLetter, rerr = policy.retry(ctx, channel, consumer.Queue, delivery, err)
+		}
+		if deadLetter {
+			outcome = outcomeDeadLetter
+		}
+		// 重新推送失败时重新入队
+		if rerr != nil {
+			log.Errorf("rabbitmq %s retry message %s err %v", consumer.Queue, delivery.MessageId, rerr)
+			outcome = outcomeRequeue
+			delivery.Nack(false, true)
+		}
+	default:
+		outcome = outcomeRequeue
+		delivery.Nack(false, true)
+	}
+	metricConsumeTotal.WithLabelValues(consumer.Exchange, consumer.Queue, outcome).Inc()
+	return outcome != outcomeRequeue
+}
+
+// invoke 调用消费方法, panic 时记录堆栈并作为处理失败返回, 不影响其他消息
+func (s *Server) invoke(ctx context.Context, consumer Consumer, h middleware.Handler, delivery amqp091.Delivery) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			buf := make([]byte, 64<<10)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Errorf("rabbitmq %s message %s panic: %v\n%s", consumer.Queue, delivery.MessageId, r, buf)
+			err = fmt.Errorf("%w: %v", ErrHandlerPanic, r)
+		}
+	}()
+	_, err = h(ctx, newMessage(consumer.Queue, delivery))
+	return err
+}
+
+// Stop 取消订阅, 在 ctx 结束前等待处理中的消息完成并确认, 之后关闭通道以及连接
+func (s *Server) Stop(ctx context.Context) (err error) {
+	// 先结束等待连接的订阅, 再获取锁
+	s.stopOnce.Do(func() { close(s.stopping) })
+	s.stopAll()
+	s.Lock()
+	for _, g := range s.groups {
+		g.halt()
+	}
+	s.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.consumers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		log.Warnf("[%s] server stopping before in-flight messages finished: %v", s.Name(), err)
+	}
+
+	if s.cancel != nil {
+		s.cancel()
 	}
-	// 关闭链接
+	// 等待重连协程关闭连接
+	s.wg.Wait()
 	for _, conn := range s.conn {
-		conn.Close()
+		states.remove(conn)
 	}
 
 	log.Infof("[%s] server stopping", s.Name())
-	return nil
+	return err
 }
 
+// AddConsumer 添加消费者, 运行中添加时立即订阅
 func (s *Server) AddConsumer(consumer Consumer) error {
-	s.RLock()
-	defer s.RUnlock()
+	s.Lock()
+	defer s.Unlock()
 
+	select {
+	case <-s.stopping:
+		return ErrServerStopped
+	default:
+	}
+	if s.started {
+		if err := s.startConsumer(consumer); err != nil {
+			return err
+		}
+	}
 	s.Consumers = append(s.Consumers, consumer)
 	return nil
 }
@@ -0,0 +1,216 @@
+package rabbitmq
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rabbitmq/amqp091-go"
+	"time"
+)
+
+// typedTable 保留值类型的消息头 JSON 编码, 写入磁盘或数据库后 int64 等类型不变
+type typedTable amqp091.Table
+
+// typedValue 消息头的值以及类型
+type typedValue struct {
+	Type  string          `json:"t"`
+	Value json.RawMessage `json:"v,omitempty"`
+}
+
+func (t typedTable) MarshalJSON() ([]byte, error) {
+	if t == nil {
+		return []byte("null"), nil
+	}
+	values := make(map[string]typedValue, len(t))
+	for k, v := range t {
+		tv, err := encodeTyped(v)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %w", k, err)
+		}
+		values[k] = tv
+	}
+	return json.Marshal(values)
+}
+
+func (t *typedTable) UnmarshalJSON(data []byte) error {
+	var values map[string]typedValue
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	if values == nil {
+		*t = nil
+		return nil
+	}
+	table := make(typedTable, len(values))
+	for k, tv := range values {
+		v, err := decodeTyped(tv)
+		if err != nil {
+			return fmt.Errorf("header %s: %w", k, err)
+		}
+		table[k] = v
+	}
+	*t = table
+	return nil
+}
+
+func encodeTyped(v interface{}) (typedValue, error) {
+	var typ string
+	switch x := v.(type) {
+	case nil:
+		return typedValue{Type: "nil"}, nil
+	case bool:
+		typ = "bool"
+	case byte:
+		typ = "byte"
+	case int8:
+		typ = "int8"
+	case int16:
+		typ = "int16"
+	case uint16:
+		typ = "uint16"
+	case int32:
+		typ = "int32"
+	case uint32:
+		typ = "uint32"
+	case int:
+		typ = "int"
+	case int64:
+		typ = "int64"
+	case float32:
+		typ = "float32"
+	case float64:
+		typ = "float64"
+	case string:
+		typ = "string"
+	case []byte:
+		typ = "bytes"
+	case time.Time:
+		typ = "time"
+	case amqp091.Decimal:
+		typ = "decimal"
+	case amqp091.Table:
+		typ, v = "table", typedTable(x)
+	case []interface{}:
+		list := make([]typedValue, len(x))
+		for i, item := range x {
+			tv, err := encodeTyped(item)
+			if err != nil {
+				return typedValue{}, err
+			}
+			list[i] = tv
+		}
+		typ, v = "array", list
+	default:
+		return typedValue{}, fmt.Errorf("unsupported type %T", v)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return typedValue{}, err
+	}
+	return typedValue{Type: typ, Value: data}, nil
+}
+
+func decodeTyped(tv typedValue) (interface{}, error) {
+	var err error
+	switch tv.Type {
+	case "nil":
+		return nil, nil
+	case "bool":
+		var v bool
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "byte":
+		var v byte
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "int8":
+		var v int8
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "int16":
+		var v int16
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "uint16":
+		var v uint16
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "int32":
+		var v int32
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "uint32":
+		var v uint32
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "int":
+		var v int
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "int64":
+		var v int64
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "float32":
+		var v float32
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "float64":
+		var v float64
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "string":
+		var v string
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "bytes":
+		var v []byte
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "time":
+		var v time.Time
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "decimal":
+		var v amqp091.Decimal
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "table":
+		var v typedTable
+		err = json.Unmarshal(tv.Value, &v)
+		return amqp091.Table(v), err
+	case "array":
+		var list []typedValue
+		if err = json.Unmarshal(tv.Value, &list); err != nil {
+			return nil, err
+		}
+		v := make([]interface{}, len(list))
+		for i, item := range list {
+			if v[i], err = decodeTyped(item); err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", tv.Type)
+}
+
+// storedPublishing 写入磁盘或数据库的消息, 消息头按类型编码
+// 旧格式的消息头在 Publishing.Headers 中, 读取时兼容
+type storedPublishing struct {
+	amqp091.Publishing
+	TypedHeaders typedTable `json:"typed_headers,omitempty"`
+}
+
+func newStoredPublishing(publishing amqp091.Publishing) storedPublishing {
+	s := storedPublishing{Publishing: publishing, TypedHeaders: typedTable(publishing.Headers)}
+	s.Publishing.Headers = nil
+	return s
+}
+
+func (s storedPublishing) publishing() amqp091.Publishing {
+	p := s.Publishing
+	if s.TypedHeaders != nil {
+		p.Headers = amqp091.Table(s.TypedHeaders)
+	}
+	return p
+}
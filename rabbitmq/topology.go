@@ -0,0 +1,126 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"github.com/rabbitmq/amqp091-go"
+	"strings"
+	"time"
+)
+
+// Binding 队列绑定, headers 交换机通过 Args 匹配(x-match 等)
+type Binding struct {
+	Key  string
+	Args amqp091.Table
+}
+
+// Topology 交换机、队列的声明以及绑定
+type Topology struct {
+	ExchangeKind       string // direct、fanout、topic、headers、x-delayed-message
+	ExchangeDurable    bool
+	ExchangeAutoDelete bool
+	ExchangeArgs       amqp091.Table
+
+	QueueType       string // classic、quorum、stream, 为空时使用 broker 默认类型
+	QueueDurable    bool   // quorum、stream 队列必须持久化
+	QueueAutoDelete bool
+	QueueArgs       amqp091.Table // 其他参数, 与下列设置同时指定时以下列设置为准
+
+	DeliveryLimit  int           // quorum 队列最多投递次数, 超过后丢弃或转入死信
+	MaxLength      int64         // 最大消息数
+	MaxLengthBytes int64         // 最大字节数, stream 队列按此保留
+	Overflow       string        // 超过长度后 drop-head、reject-publish、reject-publish-dlx
+	MessageTTL     time.Duration // 消息过期时间, stream 队列不支持
+	MaxAge         string        // stream 队列保留时间, 如 7D、12h
+	MaxPriority    uint8         // 优先级队列的最大优先级, 建议不超过 10
+
+	Bindings []Binding // 为空时以队列名作为路由键绑定
+}
+
+// conventionTopology 未声明拓扑时按交换机命名推断
+// 交换机类型取名称最后一段, 名称包含 delayed 时为延时交换机, 以队列名作为路由键绑定
+func conventionTopology(consumer Consumer) (*Topology, error) {
+	// 声明交换机延时、以及延时交换机
+	argv := amqp091.Table{}
+	exchangeSplit := strings.Split(strings.Trim(consumer.Exchange, ""), ".")
+	exchangeType := strings.ToLower(exchangeSplit[len(exchangeSplit)-1])
+	// 延时队列处理
+	if strings.Contains(consumer.Exchange, "delayed") {
+		exchangeType = "x-delayed-message"
+		argv["x-delayed-type"] = "direct"
+	}
+
+	// 验证交换机类型
+	if !strings.Contains("|direct|fanout|headers|topic|x-delayed-message|", exchangeType) {
+		return nil, fmt.Errorf("%v, RabbitMQ不存在该类型交换机", consumer.Exchange)
+	}
+
+	return &Topology{
+		ExchangeKind:    exchangeType,
+		ExchangeDurable: true,
+		ExchangeArgs:    argv,
+		QueueDurable:    true,
+	}, nil
+}
+
+// declare 声明交换机、队列以及绑定, 任一失败都返回错误
+// 交换机为空时使用默认交换机, 不声明也不绑定
+func (t *Topology) declare(channel *amqp091.Channel, exchange, queue string) error {
+	if len(exchange) > 0 {
+		if err := channel.ExchangeDeclare(exchange, t.ExchangeKind, t.ExchangeDurable, t.ExchangeAutoDelete, false, false, t.ExchangeArgs); err != nil {
+			return fmt.Errorf("declare exchange %s: %w", exchange, err)
+		}
+	}
+	if _, err := channel.QueueDeclare(queue, t.QueueDurable, t.QueueAutoDelete, false, false, t.queueArgs()); err != nil {
+		return fmt.Errorf("declare queue %s: %w", queue, err)
+	}
+	if len(exchange) == 0 {
+		return nil
+	}
+
+	bindings := t.Bindings
+	if len(bindings) == 0 {
+		bindings = []Binding{{Key: queue}}
+	}
+	for _, binding := range bindings {
+		if err := channel.QueueBind(queue, binding.Key, exchange, false, binding.Args); err != nil {
+			return fmt.Errorf("bind queue %s to %s with %q: %w", queue, exchange, binding.Key, err)
+		}
+	}
+	return nil
+}
+
+// queueArgs 合并队列类型以及长度、过期等参数
+func (t *Topology) queueArgs() amqp091.Table {
+	args := amqp091.Table{}
+	for k, v := range t.QueueArgs {
+		args[k] = v
+	}
+	if len(t.QueueType) > 0 {
+		args[amqp091.QueueTypeArg] = t.QueueType
+	}
+	if t.DeliveryLimit > 0 {
+		args["x-delivery-limit"] = int64(t.DeliveryLimit)
+	}
+	if t.MaxLength > 0 {
+		args[amqp091.QueueMaxLenArg] = t.MaxLength
+	}
+	if t.MaxLengthBytes > 0 {
+		args[amqp091.QueueMaxLenBytesArg] = t.MaxLengthBytes
+	}
+	if len(t.Overflow) > 0 {
+		args[amqp091.QueueOverflowArg] = t.Overflow
+	}
+	if t.MessageTTL > 0 {
+		args[amqp091.QueueMessageTTLArg] = t.MessageTTL.Milliseconds()
+	}
+	if t.MaxPriority > 0 {
+		args["x-max-priority"] = int64(t.MaxPriority)
+	}
+	if len(t.MaxAge) > 0 {
+		args[amqp091.StreamMaxAgeArg] = t.MaxAge
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
@@ -0,0 +1,63 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/tonyhal/hercules/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "rabbitmq"
+
+// headerCarrier 同时实现 propagation.TextMapCarrier
+var _ propagation.TextMapCarrier = headerCarrier{}
+
+// startProducerSpan 创建推送 span 并写入消息头
+func startProducerSpan(ctx context.Context, exchange, routingKey string, publishing *amqp091.Publishing) trace.Span {
+	ctx, span := tracing.Tracer(tracerName).Start(ctx, fmt.Sprintf("%s publish", exchange),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.String("messaging.destination", exchange),
+			attribute.String("messaging.rabbitmq.routing_key", routingKey),
+			attribute.String("messaging.message_id", publishing.MessageId),
+		),
+	)
+	if publishing.Headers == nil {
+		publishing.Headers = amqp091.Table{}
+	}
+	// 使用全局 propagator, 与 HTTP、gRPC 的传递方式一致
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier(publishing.Headers))
+	return span
+}
+
+// startConsumerSpan 从消息头取出推送 span, 创建关联的消费 span
+func startConsumerSpan(ctx context.Context, queue string, delivery amqp091.Delivery) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, headerCarrier(delivery.Headers))
+	return tracing.Tracer(tracerName).Start(ctx, fmt.Sprintf("%s process", queue),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(trace.LinkFromContext(ctx)),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.String("messaging.destination", delivery.Exchange),
+			attribute.String("messaging.rabbitmq.routing_key", delivery.RoutingKey),
+			attribute.String("messaging.source", queue),
+			attribute.String("messaging.message_id", delivery.MessageId),
+			attribute.Bool("messaging.redelivered", delivery.Redelivered),
+		),
+	)
+}
+
+// endSpan 记录错误并结束 span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
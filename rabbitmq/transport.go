@@ -0,0 +1,97 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"github.com/go-kratos/kratos/v2/transport"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// KindRabbitMQ 消费者的 transport 类型
+const KindRabbitMQ transport.Kind = "rabbitmq"
+
+var _ transport.Transporter = (*Transport)(nil)
+
+// Transport 消费时放入 context 的 transport, 通过 transport.FromServerContext 获取
+type Transport struct {
+	endpoint    string
+	operation   string
+	reqHeader   headerCarrier
+	replyHeader headerCarrier
+}
+
+func newTransport(exchange, queue string, headers amqp091.Table) *Transport {
+	if headers == nil {
+		headers = amqp091.Table{}
+	}
+	return &Transport{
+		endpoint:    fmt.Sprintf("amqp://%s", exchange),
+		operation:   queue,
+		reqHeader:   headerCarrier(headers),
+		replyHeader: headerCarrier{},
+	}
+}
+
+func (t *Transport) Kind() transport.Kind {
+	return KindRabbitMQ
+}
+
+// Endpoint amqp://交换机
+func (t *Transport) Endpoint() string {
+	return t.endpoint
+}
+
+// Operation 队列名
+func (t *Transport) Operation() string {
+	return t.operation
+}
+
+// RequestHeader 消息头
+func (t *Transport) RequestHeader() transport.Header {
+	return t.reqHeader
+}
+
+func (t *Transport) ReplyHeader() transport.Header {
+	return t.replyHeader
+}
+
+// headerCarrier 以 amqp 消息头实现 transport.Header
+type headerCarrier amqp091.Table
+
+func (h headerCarrier) Get(key string) string {
+	switch v := h[key].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func (h headerCarrier) Set(key string, value string) {
+	h[key] = value
+}
+
+// Add 消息头不支持多值, 已存在时不覆盖
+func (h headerCarrier) Add(key string, value string) {
+	if _, ok := h[key]; !ok {
+		h[key] = value
+	}
+}
+
+func (h headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (h headerCarrier) Values(key string) []string {
+	if _, ok := h[key]; !ok {
+		return nil
+	}
+	return []string{h.Get(key)}
+}
@@ -57,6 +57,9 @@ func HttpGet(url string, header map[string]string) (string, error) {
 		req.Header.Set(k, v)
 	}
 	resp, err := client.Do(req)
+	if err != nil {
+		return ``, err
+	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {